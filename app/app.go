@@ -56,6 +56,8 @@ func (a *App) Init() error {
 		registry.DefaultRegistry = consul_registry.NewRegistry(
 			registry.Addrs("127.0.0.1:8500"),
 		)
+	} else {
+		registry.DefaultRegistry = a.opts.registry
 	}
 
 	return nil
@@ -65,10 +67,11 @@ func (a *App) Run(serverInfo *ServerInfo) error {
 
 	var svr server.Server
 	if serverInfo.Protocol == "grpc" {
-		gs := grpc_server.NewServer(
+		opts := []server.Option{
 			server.Registry(registry.DefaultRegistry),
 			server.Host(serverInfo.Host),
-		)
+		}
+		gs := grpc_server.NewServer(append(opts, serverInfo.ServerOpts...)...)
 
 		if err := gs.Init(); err != nil {
 			return err
@@ -12,7 +12,9 @@ type ServerInfo struct {
 	Protocol string // grpc, http
 	Host     string //
 
-	StartOpts []server.StartOption
+	// ServerOpts 追加到默认的 server 选项之后, 例如 RegisterInterval
+	ServerOpts []server.Option
+	StartOpts  []server.StartOption
 }
 
 // Option is an application option.
@@ -55,6 +57,11 @@ func LogFields(v map[string]interface{}) Option {
 	return func(o *options) { o.logFields = v }
 }
 
+// Registry with service registry, defaults to consul at 127.0.0.1:8500.
+func Registry(r registry.Registry) Option {
+	return func(o *options) { o.registry = r }
+}
+
 // Signal with exit signals.
 func Signal(sigs ...os.Signal) Option {
 	return func(o *options) { o.sigs = sigs }
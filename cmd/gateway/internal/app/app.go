@@ -11,6 +11,8 @@ import (
 	"github.com/robert-pkg/base4go/log"
 	"github.com/robert-pkg/base4go/registry"
 	consul_registry "github.com/robert-pkg/base4go/registry/consul"
+	grpc_client "github.com/robert-pkg/base4go/rpc/client/grpc_client"
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/consul_resolver"
 
 	"github.com/robert-pkg/base4go/cmd/gateway/internal/config"
 	"github.com/robert-pkg/base4go/cmd/gateway/internal/handler"
@@ -51,6 +53,12 @@ func Run() {
 		registry.Addrs(cfg.Registry.Addr),
 	)
 
+	resolverOpts := resolverMetrics()
+	if len(cfg.Registry.Snapshot) > 0 {
+		resolverOpts = append(resolverOpts, consul_resolver.Snapshot(cfg.Registry.Snapshot))
+	}
+	handler.InitClientMgr(grpc_client.ConsulResolverOptions(resolverOpts...))
+
 	if err = handler.WarmGrpcClient(cfg.WarmServer.Grpc); err != nil {
 		log.Errorf("warm grpc client fail. err=%v", err)
 		os.Exit(1)
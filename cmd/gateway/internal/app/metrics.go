@@ -0,0 +1,47 @@
+package app
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/consul_resolver"
+)
+
+// consul resolver 的监控, 按 service{.dc} 统计
+var (
+	resolverProtectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consul_resolver_protected_total",
+		Help: "Times the consul resolver kept the previous addresses of a service.",
+	}, []string{"service"})
+
+	resolverProtecting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consul_resolver_protecting",
+		Help: "Whether the consul resolver is keeping the previous addresses of a service.",
+	}, []string{"service"})
+
+	resolverFailoverDC = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consul_resolver_failover_dc",
+		Help: "The datacenter a service with failover datacenters is resolved from, set to 1.",
+	}, []string{"service", "dc"})
+)
+
+func init() {
+	prometheus.MustRegister(resolverProtectedTotal, resolverProtecting, resolverFailoverDC)
+}
+
+// resolverMetrics 把 consul resolver 的保护和机房切换记录到 prometheus
+func resolverMetrics() []consul_resolver.Option {
+	return []consul_resolver.Option{
+		consul_resolver.ProtectHandler(func(service string, protecting bool) {
+			if protecting {
+				resolverProtectedTotal.WithLabelValues(service).Inc()
+				resolverProtecting.WithLabelValues(service).Set(1)
+			} else {
+				resolverProtecting.WithLabelValues(service).Set(0)
+			}
+		}),
+		consul_resolver.FailoverHandler(func(service, dc string) {
+			resolverFailoverDC.DeletePartialMatch(prometheus.Labels{"service": service})
+			resolverFailoverDC.WithLabelValues(service, dc).Set(1)
+		}),
+	}
+}
@@ -27,7 +27,8 @@ type Config struct {
 	Server Server
 
 	Registry struct {
-		Addr string `mapstructure:"addr"`
+		Addr     string `mapstructure:"addr"`
+		Snapshot string `mapstructure:"snapshot"` // 服务发现快照文件, 注册中心不可用时使用
 	}
 
 	WarmServer struct {
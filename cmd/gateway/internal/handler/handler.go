@@ -2,6 +2,7 @@ package handler
 
 import (
 	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/rpc/client"
 	grpc_client "github.com/robert-pkg/base4go/rpc/client/grpc_client"
 )
 
@@ -9,6 +10,11 @@ var (
 	g_ClientMgr = grpc_client.GetClientMgr()
 )
 
+// 使用指定的选项创建 grpc 客户端, 需在预热之前调用
+func InitClientMgr(opts ...client.Option) {
+	g_ClientMgr = grpc_client.GetClientMgr(opts...)
+}
+
 // 预热 grpc 客户端
 func WarmGrpcClient(grpcClientTargets []string) error {
 	if len(grpcClientTargets) > 0 {
@@ -1,10 +1,13 @@
 package http_server
 
 import (
+	"github.com/chenjiandongx/ginprom"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robert-pkg/base4go/cmd/gateway/internal/handler"
 )
 
 func (svr *Server) configHandle(r *gin.Engine) {
+	r.GET("/metrics", ginprom.PromHandler(promhttp.Handler()))
 	r.POST(svr.ApiPrefix+"/*api", handler.ApiHandler)
 }
@@ -0,0 +1,252 @@
+// regctl 是注册中心的命令行管理工具, 用来查看/手工注册服务, 排查注册问题.
+//
+//	regctl --registry consul://127.0.0.1:8500 list
+//	regctl get Greeter
+//	regctl -o json get Greeter
+//	regctl register --name Greeter --version v1.0.0 --id greeter-1 --address 10.0.0.5:8080 --meta k=v
+//	regctl deregister --name Greeter --id greeter-1
+//	regctl watch Greeter
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+const usage = `usage: regctl [flags] <command> [args]
+
+commands:
+  list                  列出所有服务
+  get <service>         查看服务的版本, 元数据, 接口以及节点健康状态
+  register [flags]      手工注册一个节点
+  deregister [flags]    手工注销一个节点
+  watch <service>       监听服务的变化
+
+flags:
+`
+
+func main() {
+	fs := flag.NewFlagSet("regctl", flag.ExitOnError)
+	addr := fs.String("registry", "consul://127.0.0.1:8500", "registry address, consul://addr[,addr], etcd://addr[,addr] or file:///path")
+	output := fs.String("o", "table", "output format, table or json")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	r, err := newRegistry(*addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	c := &cmd{r: r, out: os.Stdout, json: *output == "json"}
+	if err := c.run(fs.Arg(0), fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type cmd struct {
+	r    registry.Registry
+	out  io.Writer
+	json bool
+}
+
+func (c *cmd) run(name string, args []string) error {
+	switch name {
+	case "list":
+		return c.list()
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: regctl get <service>")
+		}
+		return c.get(args[0])
+	case "register":
+		return c.register(args)
+	case "deregister":
+		return c.deregister(args)
+	case "watch":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: regctl watch <service>")
+		}
+		return c.watch(args[0])
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func (c *cmd) list() error {
+	services, err := c.r.ListServices()
+	if err != nil {
+		return err
+	}
+
+	return c.printList(services)
+}
+
+func (c *cmd) get(name string) error {
+	var health map[string]string
+	services, err := c.r.GetService(name, getOptions(c.r, &health)...)
+	if err != nil {
+		return err
+	}
+
+	return c.printServices(services, health)
+}
+
+// nodeFlags 是 register/deregister 共用的参数
+type nodeFlags struct {
+	name, version, id, address string
+	metadata, nodeMetadata     kvFlag
+	ttl                        time.Duration
+	tcpCheck                   bool
+}
+
+func (n *nodeFlags) parse(cmd string, args []string, register bool) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.StringVar(&n.name, "name", "", "service name")
+	fs.StringVar(&n.version, "version", "", "service version")
+	fs.StringVar(&n.id, "id", "", "node id")
+	if register {
+		fs.StringVar(&n.address, "address", "", "node address, host:port")
+		fs.Var(&n.metadata, "meta", "service metadata k=v, can be repeated")
+		fs.Var(&n.nodeMetadata, "node-meta", "node metadata k=v, can be repeated")
+		fs.DurationVar(&n.ttl, "ttl", 0, "register with a ttl check, the node turns critical if not re-registered in time")
+		fs.BoolVar(&n.tcpCheck, "tcp-check", false, "register with a tcp check on the node address (consul only)")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if n.name == "" || n.id == "" {
+		return fmt.Errorf("%s: --name and --id are required", cmd)
+	}
+	if register && n.address == "" {
+		return fmt.Errorf("%s: --address is required", cmd)
+	}
+
+	return nil
+}
+
+func (n *nodeFlags) service() *registry.Service {
+	return &registry.Service{
+		Name:     n.name,
+		Version:  n.version,
+		Metadata: n.metadata,
+		Nodes: []*registry.Node{{
+			Id:       n.id,
+			Address:  n.address,
+			Metadata: n.nodeMetadata,
+		}},
+	}
+}
+
+func (c *cmd) register(args []string) error {
+	var n nodeFlags
+	if err := n.parse("register", args, true); err != nil {
+		return err
+	}
+
+	opts := []registry.RegisterOption{registry.RegisterTTL(n.ttl)}
+	if n.tcpCheck {
+		opts = append(opts, tcpCheck())
+	}
+
+	if err := c.r.Register(n.service(), opts...); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "registered %s %s\n", n.name, n.id)
+	return nil
+}
+
+func (c *cmd) deregister(args []string) error {
+	var n nodeFlags
+	if err := n.parse("deregister", args, false); err != nil {
+		return err
+	}
+
+	if err := c.r.Deregister(n.service()); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "deregistered %s %s\n", n.name, n.id)
+	return nil
+}
+
+func (c *cmd) watch(name string) error {
+	w, err := c.r.Watch(registry.WatchService(name))
+	if err != nil {
+		return err
+	}
+
+	// ctrl+c 时停止监听
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		w.Stop()
+	}()
+
+	return c.watchLoop(w)
+}
+
+func (c *cmd) watchLoop(w registry.Watcher) error {
+	for {
+		res, err := w.Next()
+		if err == registry.ErrWatcherStopped {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := c.printResult(res); err != nil {
+			return err
+		}
+	}
+}
+
+// kvFlag 收集可重复的 k=v 参数
+type kvFlag map[string]string
+
+func (f *kvFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for k, v := range *f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *kvFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not k=v", s)
+	}
+
+	if *f == nil {
+		*f = make(map[string]string)
+	}
+	(*f)[k] = v
+	return nil
+}
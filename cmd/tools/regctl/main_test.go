@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+
+	"github.com/robert-pkg/base4go/internal/testutil/consultest"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+)
+
+func TestRegisterGetDeregister(t *testing.T) {
+	var out bytes.Buffer
+	c := &cmd{r: memory.NewRegistry(), out: &out}
+
+	err := c.run("register", []string{
+		"--name", "Greeter", "--version", "v1", "--id", "g-1",
+		"--address", "127.0.0.1:1001", "--meta", "desc=hello", "--node-meta", "gray=true",
+	})
+	if err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	out.Reset()
+	if err := c.run("get", []string{"Greeter"}); err != nil {
+		t.Fatalf("get err: %v", err)
+	}
+	for _, want := range []string{"v1", "desc=hello", "g-1", "127.0.0.1:1001", "gray=true"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("get output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	c.json = true
+	if err := c.run("list", nil); err != nil {
+		t.Fatalf("list err: %v", err)
+	}
+	var names []string
+	if err := json.Unmarshal(out.Bytes(), &names); err != nil || len(names) != 1 || names[0] != "Greeter" {
+		t.Fatalf("unexpected list output %q, err: %v", out.String(), err)
+	}
+
+	if err := c.run("deregister", []string{"--name", "Greeter", "--version", "v1", "--id", "g-1"}); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+	if _, err := c.r.GetService("Greeter"); err != registry.ErrNotFound {
+		t.Fatalf("expected ErrNotFound after deregister, got %v", err)
+	}
+}
+
+func TestGetConsulHealth(t *testing.T) {
+	r, err := newRegistry("consul://" + consultest.NewServer(t).Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"g-1", "g-2"} {
+		err := r.Register(&registry.Service{
+			Name:    "Greeter",
+			Version: "v1",
+			Nodes:   []*registry.Node{{Id: id, Address: "127.0.0.1:1001"}},
+		}, registry.RegisterTTL(time.Minute))
+		if err != nil {
+			t.Fatalf("register %s err: %v", id, err)
+		}
+	}
+	if err := r.(consulClient).Client().Agent().FailTTL("service:g-2", ""); err != nil {
+		t.Fatalf("fail ttl err: %v", err)
+	}
+
+	var out bytes.Buffer
+	c := &cmd{r: r, out: &out, json: true}
+	if err := c.run("get", []string{"Greeter"}); err != nil {
+		t.Fatalf("get err: %v", err)
+	}
+
+	var v struct {
+		Services []*serviceView `json:"services"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &v); err != nil || len(v.Services) != 1 {
+		t.Fatalf("unexpected get output %q, err: %v", out.String(), err)
+	}
+
+	// critical 节点也要列出来
+	health := make(map[string]string)
+	for _, n := range v.Services[0].Nodes {
+		health[n.Id] = n.Health
+	}
+	if health["g-1"] != consul_api.HealthPassing || health["g-2"] != consul_api.HealthCritical {
+		t.Errorf("unexpected node health: %v", health)
+	}
+}
+
+func TestRegisterRequiresFlags(t *testing.T) {
+	c := &cmd{r: memory.NewRegistry(), out: &bytes.Buffer{}}
+	if err := c.run("register", []string{"--name", "Greeter", "--id", "g-1"}); err == nil {
+		t.Fatal("expected error without --address")
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	for addr, want := range map[string]string{
+		"consul://127.0.0.1:8500,127.0.0.2:8500?dc=dc1": "consul",
+		"etcd://127.0.0.1:2379":                         "etcd",
+	} {
+		r, err := newRegistry(addr)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if r.String() != want {
+			t.Fatalf("%s: got %s, want %s", addr, r.String(), want)
+		}
+	}
+
+	if _, err := newRegistry("zk://127.0.0.1"); err == nil {
+		t.Fatal("expected error for unsupported registry")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+type nodeView struct {
+	Id       string            `json:"id"`
+	Address  string            `json:"address"`
+	Health   string            `json:"health,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type serviceView struct {
+	Name      string               `json:"name"`
+	Version   string               `json:"version"`
+	Metadata  map[string]string    `json:"metadata,omitempty"`
+	Endpoints []*registry.Endpoint `json:"endpoints,omitempty"`
+	Nodes     []*nodeView          `json:"nodes"`
+}
+
+func (c *cmd) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cmd) printList(services []*registry.Service) error {
+	names := make([]string, 0, len(services))
+	seen := make(map[string]bool)
+	for _, s := range services {
+		if !seen[s.Name] {
+			seen[s.Name] = true
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+
+	if c.json {
+		return c.printJSON(names)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE")
+	for _, name := range names {
+		fmt.Fprintln(tw, name)
+	}
+	return tw.Flush()
+}
+
+// printServices 输出服务详情. health 为空时不输出健康状态.
+func (c *cmd) printServices(services []*registry.Service, health map[string]string) error {
+	views := make([]*serviceView, 0, len(services))
+	for _, s := range services {
+		v := &serviceView{
+			Name:      s.Name,
+			Version:   s.Version,
+			Metadata:  s.Metadata,
+			Endpoints: s.Endpoints,
+		}
+		for _, n := range s.Nodes {
+			v.Nodes = append(v.Nodes, &nodeView{
+				Id:       n.Id,
+				Address:  n.Address,
+				Health:   health[n.Id],
+				Metadata: n.Metadata,
+			})
+		}
+		views = append(views, v)
+	}
+
+	if c.json {
+		return c.printJSON(struct {
+			Services []*serviceView `json:"services"`
+		}{views})
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	for i, v := range views {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		fmt.Fprintf(tw, "SERVICE:\t%s\n", v.Name)
+		fmt.Fprintf(tw, "VERSION:\t%s\n", v.Version)
+		fmt.Fprintf(tw, "METADATA:\t%s\n", formatMap(v.Metadata))
+
+		fmt.Fprintln(tw, "ENDPOINTS:")
+		for _, e := range v.Endpoints {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", e.Name, valueName(e.Request), valueName(e.Response))
+		}
+
+		fmt.Fprintln(tw, "NODES:")
+		fmt.Fprintln(tw, "  ID\tADDRESS\tHEALTH\tMETADATA")
+		for _, n := range v.Nodes {
+			h := n.Health
+			if h == "" {
+				h = "-"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", n.Id, n.Address, h, formatMap(n.Metadata))
+		}
+	}
+
+	return tw.Flush()
+}
+
+func (c *cmd) printResult(res *registry.Result) error {
+	if c.json {
+		return c.printJSON(struct {
+			Action  string            `json:"action"`
+			Service *registry.Service `json:"service"`
+		}{res.Action, res.Service})
+	}
+
+	nodes := make([]string, 0, len(res.Service.Nodes))
+	for _, n := range res.Service.Nodes {
+		nodes = append(nodes, n.Id+"@"+n.Address)
+	}
+
+	_, err := fmt.Fprintf(c.out, "%s\t%s\t%s\t[%s]\n", res.Action, res.Service.Name, res.Service.Version, strings.Join(nodes, " "))
+	return err
+}
+
+func formatMap(m map[string]string) string {
+	if len(m) == 0 {
+		return "-"
+	}
+
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func valueName(v *registry.Value) string {
+	if v == nil {
+		return "-"
+	}
+	return v.Type
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/consul"
+	"github.com/robert-pkg/base4go/registry/etcd"
+	"github.com/robert-pkg/base4go/registry/file"
+)
+
+// newRegistry 根据 --registry 创建注册中心.
+// consul 支持 ?token=xx&dc=xx&encoding=meta 参数.
+func newRegistry(addr string) (registry.Registry, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry %q: %v", addr, err)
+	}
+
+	var addrs []string
+	if u.Host != "" {
+		addrs = strings.Split(u.Host, ",")
+	}
+
+	q := u.Query()
+	switch u.Scheme {
+	case "consul":
+		opts := []registry.Option{registry.Addrs(addrs...), registry.Timeout(10 * time.Second)}
+		if v := q.Get("token"); v != "" {
+			opts = append(opts, consul.Token(v))
+		}
+		if v := q.Get("dc"); v != "" {
+			opts = append(opts, consul.Datacenter(v))
+		}
+		if q.Get("encoding") == "meta" {
+			opts = append(opts, consul.Encoding(consul.EncodingMeta))
+		}
+		return consul.NewRegistry(opts...), nil
+	case "etcd":
+		opts := []registry.Option{registry.Addrs(addrs...), registry.Timeout(10 * time.Second)}
+		if v := q.Get("prefix"); v != "" {
+			opts = append(opts, etcd.Prefix(v))
+		}
+		return etcd.NewRegistry(opts...), nil
+	case "file":
+		return file.NewRegistry(file.Path(u.Host+u.Path), file.WriteBack(true)), nil
+	default:
+		return nil, fmt.Errorf("unsupported registry %q, must be consul://, etcd:// or file://", addr)
+	}
+}
+
+// tcpCheck 让 consul 对节点地址做 tcp 检查, 其他注册中心忽略
+func tcpCheck() registry.RegisterOption {
+	return consul.TCPCheck("", 10*time.Second, 3*time.Second)
+}
+
+// consulClient 由 consul 注册中心实现
+type consulClient interface {
+	Client() *consul_api.Client
+}
+
+// getOptions 返回 get 命令查询服务的参数, health 用于接收节点的健康状态.
+// consul 默认跳过 critical 节点, 这里要求返回全部节点, 健康状态取自同一次查询.
+// 其他注册中心没有健康检查, health 保持为空.
+func getOptions(r registry.Registry, health *map[string]string) []registry.GetOption {
+	if _, ok := r.(consulClient); !ok {
+		return nil
+	}
+
+	return []registry.GetOption{
+		consul.IncludeCritical(true),
+		consul.HealthResult(func(h map[string]string) { *health = h }),
+	}
+}
@@ -0,0 +1,391 @@
+// Package consultest runs an in-process consul agent for tests. It serves
+// the HTTP endpoints the consul registry uses: service register and
+// deregister, TTL checks that go critical and are reaped after
+// DeregisterCriticalServiceAfter, health and catalog queries, and blocking
+// queries on X-Consul-Index.
+//
+// TCP and HTTP checks are not run, they are reported as passing.
+package consultest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	nodeName    = "consultest"
+	nodeAddress = "127.0.0.1"
+	datacenter  = "dc1"
+)
+
+// Server is an in-process consul agent.
+type Server struct {
+	srv *httptest.Server
+
+	mu    sync.Mutex
+	index uint64
+	// 每次变化时关闭并替换, 用于唤醒阻塞查询
+	changed  chan struct{}
+	services map[string]*service
+}
+
+type service struct {
+	reg   *consul.AgentServiceRegistration
+	check *check
+}
+
+type check struct {
+	status     string
+	ttl        time.Duration
+	deregAfter time.Duration
+	// ttl 到期后置为 critical
+	ttlTimer *time.Timer
+	// critical 持续 deregAfter 后注销服务
+	deregTimer *time.Timer
+}
+
+// NewServer starts a server, it's closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]*service),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/host", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/v1/agent/service/register", s.register)
+	mux.HandleFunc("/v1/agent/service/deregister/", s.deregister)
+	mux.HandleFunc("/v1/agent/check/", s.updateCheck)
+	mux.HandleFunc("/v1/health/checks/", s.healthChecks)
+	mux.HandleFunc("/v1/health/service/", s.healthService)
+	mux.HandleFunc("/v1/catalog/services", s.catalogServices)
+
+	s.srv = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return strings.TrimPrefix(s.srv.URL, "http://")
+}
+
+// Close stops the server, it's safe to call more than once.
+func (s *Server) Close() {
+	// 阻塞查询不会自己结束, 先断开连接
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, svc := range s.services {
+		svc.check.stop()
+	}
+}
+
+func (c *check) stop() {
+	if c == nil {
+		return
+	}
+	if c.ttlTimer != nil {
+		c.ttlTimer.Stop()
+	}
+	if c.deregTimer != nil {
+		c.deregTimer.Stop()
+	}
+}
+
+// bump 在持有锁时调用, 增加索引并唤醒阻塞查询
+func (s *Server) bump() {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func newCheck(c *consul.AgentServiceCheck) (*check, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	chk := &check{status: consul.HealthPassing}
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return nil, err
+		}
+		// 和 consul 一样, ttl 检查在第一次续约前是 critical
+		chk.ttl = ttl
+		chk.status = consul.HealthCritical
+	}
+	if c.Status != "" {
+		chk.status = c.Status
+	}
+	if c.DeregisterCriticalServiceAfter != "" {
+		d, err := time.ParseDuration(c.DeregisterCriticalServiceAfter)
+		if err != nil {
+			return nil, err
+		}
+		chk.deregAfter = d
+	}
+
+	return chk, nil
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var reg consul.AgentServiceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reg.ID == "" {
+		reg.ID = reg.Name
+	}
+
+	chk, err := newCheck(reg.Check)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.services[reg.ID]; ok {
+		old.check.stop()
+	}
+	s.services[reg.ID] = &service{reg: &reg, check: chk}
+	if chk != nil {
+		s.setStatus(reg.ID, chk, chk.status)
+	}
+	s.bump()
+}
+
+func (s *Server) deregister(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	svc, ok := s.services[id]
+	if !ok {
+		http.Error(w, "Unknown service ID "+strconv.Quote(id), http.StatusNotFound)
+		return
+	}
+	svc.check.stop()
+	delete(s.services, id)
+	s.bump()
+}
+
+// updateCheck 处理 /v1/agent/check/{pass,warn,fail,update}/service:<id>
+func (s *Server) updateCheck(w http.ResponseWriter, r *http.Request) {
+	action, checkID, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/agent/check/"), "/")
+
+	var status string
+	switch action {
+	case "pass":
+		status = consul.HealthPassing
+	case "warn":
+		status = consul.HealthWarning
+	case "fail":
+		status = consul.HealthCritical
+	case "update":
+		var u struct{ Status string }
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status = u.Status
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := strings.TrimPrefix(checkID, "service:")
+	svc, ok := s.services[id]
+	if !ok || svc.check == nil || svc.check.ttl == 0 {
+		http.Error(w, "Unknown check ID "+strconv.Quote(checkID), http.StatusNotFound)
+		return
+	}
+	s.setStatus(id, svc.check, status)
+}
+
+// setStatus 在持有锁时调用, 更新检查状态并重置 ttl 和注销计时器
+func (s *Server) setStatus(id string, c *check, status string) {
+	c.stop()
+	if c.status != status {
+		c.status = status
+		s.bump()
+	}
+
+	if c.ttl > 0 && status != consul.HealthCritical {
+		c.ttlTimer = time.AfterFunc(c.ttl, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if svc, ok := s.services[id]; ok && svc.check == c {
+				s.setStatus(id, c, consul.HealthCritical)
+			}
+		})
+	}
+
+	if c.deregAfter > 0 && status == consul.HealthCritical {
+		c.deregTimer = time.AfterFunc(c.deregAfter, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if svc, ok := s.services[id]; ok && svc.check == c {
+				delete(s.services, id)
+				s.bump()
+			}
+		})
+	}
+}
+
+// block 实现阻塞查询: index 参数不小于当前索引时, 等待变化或 wait 超时.
+// 返回时持有锁.
+func (s *Server) block(r *http.Request) {
+	q := r.URL.Query()
+	index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+	wait := 5 * time.Minute
+	if v := q.Get("wait"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			wait = d
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	s.mu.Lock()
+	for index > 0 && index >= s.index {
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			s.mu.Lock()
+			return
+		case <-r.Context().Done():
+			s.mu.Lock()
+			return
+		}
+
+		s.mu.Lock()
+	}
+}
+
+// reply 在持有锁时调用, 写入查询结果和索引
+func (s *Server) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	json.NewEncoder(w).Encode(v)
+}
+
+// sorted 在持有锁时调用, 返回按 id 排序的服务
+func (s *Server) sorted() []*service {
+	services := make([]*service, 0, len(s.services))
+	for _, svc := range s.services {
+		services = append(services, svc)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].reg.ID < services[j].reg.ID
+	})
+	return services
+}
+
+func (svc *service) healthCheck() *consul.HealthCheck {
+	return &consul.HealthCheck{
+		Node:        nodeName,
+		CheckID:     "service:" + svc.reg.ID,
+		Name:        "Service '" + svc.reg.Name + "' check",
+		Status:      svc.check.status,
+		ServiceID:   svc.reg.ID,
+		ServiceName: svc.reg.Name,
+		ServiceTags: svc.reg.Tags,
+		Type:        "ttl",
+	}
+}
+
+func (s *Server) healthChecks(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/checks/")
+
+	s.block(r)
+	defer s.mu.Unlock()
+
+	checks := consul.HealthChecks{}
+	for _, svc := range s.sorted() {
+		if svc.reg.Name == name && svc.check != nil {
+			checks = append(checks, svc.healthCheck())
+		}
+	}
+	s.reply(w, checks)
+}
+
+func (s *Server) healthService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	_, passingOnly := r.URL.Query()["passing"]
+
+	s.block(r)
+	defer s.mu.Unlock()
+
+	entries := []*consul.ServiceEntry{}
+	for _, svc := range s.sorted() {
+		if svc.reg.Name != name {
+			continue
+		}
+
+		checks := consul.HealthChecks{{
+			Node:    nodeName,
+			CheckID: "serfHealth",
+			Name:    "Serf Health Status",
+			Status:  consul.HealthPassing,
+		}}
+		if svc.check != nil {
+			checks = append(checks, svc.healthCheck())
+		}
+		if passingOnly && checks.AggregatedStatus() != consul.HealthPassing {
+			continue
+		}
+
+		entries = append(entries, &consul.ServiceEntry{
+			Node: &consul.Node{Node: nodeName, Address: nodeAddress, Datacenter: datacenter},
+			Service: &consul.AgentService{
+				ID:      svc.reg.ID,
+				Service: svc.reg.Name,
+				Tags:    svc.reg.Tags,
+				Meta:    svc.reg.Meta,
+				Port:    svc.reg.Port,
+				Address: svc.reg.Address,
+			},
+			Checks: checks,
+		})
+	}
+	s.reply(w, entries)
+}
+
+func (s *Server) catalogServices(w http.ResponseWriter, r *http.Request) {
+	s.block(r)
+	defer s.mu.Unlock()
+
+	services := map[string][]string{"consul": {}}
+	for _, svc := range s.services {
+		services[svc.reg.Name] = append(services[svc.reg.Name], svc.reg.Tags...)
+	}
+	s.reply(w, services)
+}
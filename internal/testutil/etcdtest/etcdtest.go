@@ -0,0 +1,53 @@
+// Package etcdtest runs an embedded etcd server for tests.
+package etcdtest
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Server is an embedded single member etcd server.
+type Server struct {
+	e *embed.Etcd
+}
+
+// NewServer starts a server on random local ports with its data in a
+// temporary directory, it is stopped when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	local, _ := url.Parse("http://127.0.0.1:0")
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*local}
+	cfg.AdvertiseClientUrls = []url.URL{*local}
+	cfg.ListenPeerUrls = []url.URL{*local}
+	cfg.AdvertisePeerUrls = []url.URL{*local}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start etcd err: %v", err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case err := <-e.Err():
+		t.Fatalf("etcd err: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for etcd to start")
+	}
+
+	return &Server{e: e}
+}
+
+// Addr returns the host:port clients connect to.
+func (s *Server) Addr() string {
+	return s.e.Clients[0].Addr().String()
+}
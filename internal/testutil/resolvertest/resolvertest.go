@@ -0,0 +1,90 @@
+// Package resolvertest provides a resolver.ClientConn that records what a
+// gRPC resolver reports, for the resolver tests.
+package resolvertest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// ClientConn records the states and errors reported by a resolver.
+type ClientConn struct {
+	resolver.ClientConn
+
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (c *ClientConn) UpdateState(s resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, s)
+	return nil
+}
+
+func (c *ClientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+// State returns the last reported state, false if none has been reported.
+func (c *ClientConn) State() (resolver.State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.states) == 0 {
+		return resolver.State{}, false
+	}
+	return c.states[len(c.states)-1], true
+}
+
+// Addrs returns the addresses of the last reported state.
+func (c *ClientConn) Addrs() []string {
+	s, _ := c.State()
+
+	var addrs []string
+	for _, a := range s.Addresses {
+		addrs = append(addrs, a.Addr)
+	}
+	return addrs
+}
+
+// Errors returns the reported errors.
+func (c *ClientConn) Errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error(nil), c.errs...)
+}
+
+// WaitState waits up to 5 seconds for a reported state matching fn.
+func WaitState(t testing.TB, cc *ClientConn, fn func(resolver.State) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s, ok := cc.State(); ok && fn(s) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for resolver state, got %v", cc.Addrs())
+}
+
+// WaitAddrs waits up to 5 seconds for a reported state with exactly the given addresses.
+func WaitAddrs(t testing.TB, cc *ClientConn, want ...string) {
+	t.Helper()
+	WaitState(t, cc, func(s resolver.State) bool {
+		if len(s.Addresses) != len(want) {
+			return false
+		}
+		for i, a := range s.Addresses {
+			if a.Addr != want[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
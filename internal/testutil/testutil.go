@@ -0,0 +1,17 @@
+// Package testutil holds helpers shared by the tests of this module.
+package testutil
+
+import (
+	"github.com/robert-pkg/base4go/log"
+	zap_log "github.com/robert-pkg/base4go/log/zap"
+)
+
+// InitLogger sets log.DefaultLogger to a zap logger, the packages under
+// test log through it and it is nil until set. Call it from TestMain.
+func InitLogger() {
+	l, err := zap_log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	log.DefaultLogger = l
+}
@@ -0,0 +1,288 @@
+// Package cache provides a registry cache which keeps serving the last
+// known good result when the registry fails.
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+var (
+	DefaultTTL = time.Minute
+	// DefaultIdleTimeout is how long a service is kept without being read
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+// Cache is the registry cache interface.
+type Cache interface {
+	// embed the registry interface
+	registry.Registry
+	// Stop the cache refresh
+	Stop()
+}
+
+// Keyer is implemented by registries whose GetOptions select a different
+// result, such as another datacenter or only passing nodes. CacheKey returns
+// the part of the cache key given by opts.
+type Keyer interface {
+	CacheKey(opts ...registry.GetOption) string
+}
+
+type entry struct {
+	services   []*registry.Service
+	lastUpdate time.Time
+	lastRead   time.Time
+	// 带参数的调用的结果, 由调用方自己刷新
+	direct bool
+}
+
+type cache struct {
+	registry.Registry
+	opts Options
+
+	sg singleflight.Group
+
+	sync.Mutex
+	entries map[string]*entry
+
+	exit chan bool
+	once sync.Once
+}
+
+func (c *cache) isFresh(e entry) bool {
+	return time.Since(e.lastUpdate) < c.opts.TTL
+}
+
+// fetch 从注册中心获取服务并更新缓存, 相同服务的并发请求合并为一个
+func (c *cache) fetch(name string) ([]*registry.Service, error) {
+	v, err, _ := c.sg.Do(name, func() (interface{}, error) {
+		return c.Registry.GetService(name)
+	})
+
+	if err == nil {
+		services := v.([]*registry.Service)
+		c.store(name, services, false)
+		return copyServices(services), nil
+	}
+
+	if errors.Is(err, registry.ErrNotFound) {
+		// 服务确实不存在, 不是注册中心的故障
+		c.remove(name)
+	}
+
+	return nil, err
+}
+
+// store 保存查询结果. 后台刷新保留原来的读取时间, 带参数的调用本身就是一次读取.
+func (c *cache) store(key string, services []*registry.Service, direct bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e := &entry{
+		services:   copyServices(services),
+		lastUpdate: time.Now(),
+		lastRead:   time.Now(),
+		direct:     direct,
+	}
+	if old, ok := c.entries[key]; ok && !direct {
+		e.lastRead = old.lastRead
+	}
+	c.entries[key] = e
+}
+
+func (c *cache) remove(key string) {
+	c.Lock()
+	delete(c.entries, key)
+	c.Unlock()
+}
+
+// get 返回缓存的副本并记录读取时间, 长时间没有读取的缓存会被删除
+func (c *cache) get(key string) (entry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return entry{}, false
+	}
+	e.lastRead = time.Now()
+	return *e, true
+}
+
+// stale 注册中心出错时返回上一次的结果, 没有缓存时返回 err
+func (c *cache) stale(key, name string, err error) ([]*registry.Service, error) {
+	e, ok := c.get(key)
+	if !ok {
+		return nil, err
+	}
+
+	log.Warnf("registry cache serving stale service:%s last update:%v err:%v", name, e.lastUpdate, err)
+	if c.opts.StaleHandler != nil {
+		c.opts.StaleHandler(name, e.lastUpdate, err)
+	}
+
+	return copyServices(e.services), nil
+}
+
+// GetService 缓存未过期时直接返回缓存, 否则请求注册中心, 出错时返回上一次的结果.
+func (c *cache) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	if len(opts) > 0 {
+		return c.getDirect(name, opts...)
+	}
+
+	if e, ok := c.get(name); ok && c.isFresh(e) {
+		return copyServices(e.services), nil
+	}
+
+	services, err := c.fetch(name)
+	if err == nil || errors.Is(err, registry.ErrNotFound) {
+		return services, err
+	}
+
+	return c.stale(name, name, err)
+}
+
+// getDirect 处理带有 GetOption 的调用(如其他机房、阻塞查询): 总是请求注册中心,
+// 结果按 Keyer 给出的 key 单独保存, 出错时返回上一次的结果.
+// 注册中心没有实现 Keyer 时无法区分参数, 既不写入缓存也不返回缓存.
+func (c *cache) getDirect(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	k, ok := c.Registry.(Keyer)
+	if !ok {
+		return c.Registry.GetService(name, opts...)
+	}
+	key := name + "?" + k.CacheKey(opts...)
+
+	services, err := c.Registry.GetService(name, opts...)
+	if err == nil {
+		c.store(key, services, true)
+		return services, nil
+	}
+
+	if errors.Is(err, registry.ErrNotFound) {
+		c.remove(key)
+		return nil, err
+	}
+
+	return c.stale(key, name, err)
+}
+
+func (c *cache) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	err := c.Registry.Register(s, opts...)
+	if err == nil {
+		c.invalidate(s.Name)
+	}
+	return err
+}
+
+func (c *cache) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	err := c.Registry.Deregister(s, opts...)
+	if err == nil {
+		c.invalidate(s.Name)
+	}
+	return err
+}
+
+// invalidate 使缓存立即过期, 但保留内容用于故障时返回
+func (c *cache) invalidate(name string) {
+	c.Lock()
+	if e, ok := c.entries[name]; ok {
+		e.lastUpdate = time.Time{}
+	}
+	c.Unlock()
+}
+
+// refresh 定期刷新已缓存的服务, 删除长时间没有读取的服务
+func (c *cache) refresh() {
+	t := time.NewTicker(c.opts.RefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.exit:
+			return
+		case <-t.C:
+			c.Lock()
+			names := make([]string, 0, len(c.entries))
+			for key, e := range c.entries {
+				if time.Since(e.lastRead) > c.opts.IdleTimeout {
+					delete(c.entries, key)
+					continue
+				}
+				if !e.direct {
+					names = append(names, key)
+				}
+			}
+			c.Unlock()
+
+			// 刷新失败时保留原来的缓存, 没有返回给调用方, 不算作 stale
+			for _, name := range names {
+				if _, err := c.fetch(name); err != nil && !errors.Is(err, registry.ErrNotFound) {
+					log.Debugf("registry cache refresh service:%s err:%v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func (c *cache) Stop() {
+	c.once.Do(func() {
+		close(c.exit)
+	})
+}
+
+func (c *cache) String() string {
+	return "cache"
+}
+
+// New returns a new cache.
+func New(r registry.Registry, opts ...Option) Cache {
+	options := Options{
+		TTL: DefaultTTL,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	// 非正数的间隔会让 time.NewTicker panic
+	if options.TTL <= 0 {
+		options.TTL = DefaultTTL
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = options.TTL / 2
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = options.TTL
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = DefaultIdleTimeout
+	}
+
+	c := &cache{
+		Registry: r,
+		opts:     options,
+		entries:  make(map[string]*entry),
+		exit:     make(chan bool),
+	}
+
+	go c.refresh()
+
+	return c
+}
+
+func copyServices(services []*registry.Service) []*registry.Service {
+	cp := make([]*registry.Service, 0, len(services))
+	for _, s := range services {
+		svc := *s
+		svc.Nodes = make([]*registry.Node, len(s.Nodes))
+		copy(svc.Nodes, s.Nodes)
+		cp = append(cp, &svc)
+	}
+	return cp
+}
@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+	"github.com/robert-pkg/base4go/registry/registrytest"
+)
+
+type flakyRegistry struct {
+	registry.Registry
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+var errDown = errors.New("registry down")
+
+func (f *flakyRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	f.calls.Add(1)
+	if f.down.Load() {
+		return nil, errDown
+	}
+	return f.Registry.GetService(name, opts...)
+}
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func TestStaleOnError(t *testing.T) {
+	r := &flakyRegistry{Registry: memory.NewRegistry()}
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "a", Address: "a:8080"}},
+	})
+
+	var stale atomic.Int32
+	c := New(r,
+		WithTTL(time.Millisecond*50),
+		WithRefreshInterval(time.Hour),
+		WithStaleHandler(func(service string, lastUpdate time.Time, err error) {
+			stale.Add(1)
+		}),
+	)
+	defer c.Stop()
+
+	if _, err := c.GetService("Greeter"); err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+
+	// 缓存未过期时不请求注册中心
+	if _, err := c.GetService("Greeter"); err != nil || r.calls.Load() != 1 {
+		t.Fatalf("expected cached result, calls:%d err:%v", r.calls.Load(), err)
+	}
+
+	r.down.Store(true)
+	time.Sleep(time.Millisecond * 100)
+
+	services, err := c.GetService("Greeter")
+	if err != nil || len(services) != 1 || services[0].Nodes[0].Id != "a" {
+		t.Fatalf("expected stale result, got %+v %v", services, err)
+	}
+	if stale.Load() != 1 {
+		t.Errorf("expected stale handler to be called once, got %d", stale.Load())
+	}
+
+	if _, err := c.GetService("Unknown"); !errors.Is(err, errDown) {
+		t.Errorf("expected backend error for uncached service, got %v", err)
+	}
+}
+
+func TestBackgroundRefresh(t *testing.T) {
+	r := memory.NewRegistry()
+	s := &registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "a", Address: "a:8080"}},
+	}
+	r.Register(s)
+
+	c := New(r, WithTTL(time.Hour), WithRefreshInterval(time.Millisecond*20))
+	defer c.Stop()
+
+	c.GetService("Greeter")
+
+	// 绕过缓存直接注册, 等待后台刷新
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "b", Address: "b:8080"}},
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		services, _ := c.GetService("Greeter")
+		if len(services) == 1 && len(services[0].Nodes) == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("cache was not refreshed in the background")
+}
+
+type dcKey struct{}
+
+func withDC(dc string) registry.GetOption {
+	return func(o *registry.GetOptions) {
+		o.Context = context.WithValue(context.Background(), dcKey{}, dc)
+	}
+}
+
+// keyedRegistry 按 withDC 给出的机房返回不同的节点
+type keyedRegistry struct {
+	*flakyRegistry
+}
+
+func (k keyedRegistry) CacheKey(opts ...registry.GetOption) string {
+	var o registry.GetOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dc, _ := o.Context.Value(dcKey{}).(string)
+	return "dc=" + dc
+}
+
+func (k keyedRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	ss, err := k.flakyRegistry.GetService(name)
+	if err != nil {
+		return nil, err
+	}
+	ss = copyServices(ss)
+	ss[0].Nodes[0] = &registry.Node{Id: k.CacheKey(opts...)}
+	return ss, nil
+}
+
+func TestOptions(t *testing.T) {
+	r := &flakyRegistry{Registry: memory.NewRegistry()}
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "a", Address: "a:8080"}},
+	})
+
+	var stale atomic.Int32
+	c := New(keyedRegistry{r},
+		WithTTL(time.Hour),
+		WithRefreshInterval(time.Millisecond*20),
+		WithStaleHandler(func(service string, lastUpdate time.Time, err error) {
+			stale.Add(1)
+		}),
+	)
+	defer c.Stop()
+
+	for _, dc := range []string{"dc1", "dc2"} {
+		if _, err := c.GetService("Greeter", withDC(dc)); err != nil {
+			t.Fatalf("get service err: %v", err)
+		}
+	}
+
+	// 带参数的调用总是请求注册中心
+	calls := r.calls.Load()
+	c.GetService("Greeter", withDC("dc1"))
+	if r.calls.Load() != calls+1 {
+		t.Errorf("expected a call with options to reach the registry")
+	}
+
+	// 后台刷新失败不算作 stale
+	r.down.Store(true)
+	time.Sleep(time.Millisecond * 100)
+	if stale.Load() != 0 {
+		t.Errorf("expected no stale report from refresh, got %d", stale.Load())
+	}
+
+	// 出错时按参数返回各自的上一次结果
+	for _, dc := range []string{"dc1", "dc2"} {
+		ss, err := c.GetService("Greeter", withDC(dc))
+		if err != nil || len(ss) != 1 || ss[0].Nodes[0].Id != "dc="+dc {
+			t.Errorf("%s: expected the stale result, got %+v %v", dc, ss, err)
+		}
+	}
+	if stale.Load() != 2 {
+		t.Errorf("expected 2 stale reports, got %d", stale.Load())
+	}
+	if _, err := c.GetService("Greeter", withDC("dc3")); !errors.Is(err, errDown) {
+		t.Errorf("expected backend error for an uncached dc, got %v", err)
+	}
+
+	// 注册中心不能区分参数时, 不使用缓存
+	plain := New(r, WithTTL(time.Hour))
+	defer plain.Stop()
+	r.down.Store(false)
+	plain.GetService("Greeter", withDC("dc1"))
+	r.down.Store(true)
+	if _, err := plain.GetService("Greeter", withDC("dc1")); !errors.Is(err, errDown) {
+		t.Errorf("expected backend error without a Keyer, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	r := memory.NewRegistry()
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "a", Address: "a:8080"}},
+	})
+
+	c := New(r, WithTTL(time.Hour), WithRefreshInterval(time.Millisecond*10), WithIdleTimeout(time.Millisecond*50)).(*cache)
+	defer c.Stop()
+
+	c.GetService("Greeter")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.Lock()
+		n := len(c.entries)
+		c.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("idle service was not dropped")
+}
+
+func TestDefaults(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithTTL(0)},
+		{WithTTL(-time.Second), WithRefreshInterval(-time.Second)},
+		{WithTTL(time.Nanosecond)},
+	} {
+		c := New(memory.NewRegistry(), opts...).(*cache)
+		if c.opts.TTL <= 0 || c.opts.RefreshInterval <= 0 {
+			t.Errorf("expected positive durations, got %+v", c.opts)
+		}
+		c.Stop()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func() registry.Registry {
+		// 心跳超时不会让缓存失效, ttl 要小于等待的时间
+		c := New(memory.NewRegistry(), WithTTL(time.Second))
+		t.Cleanup(c.Stop)
+		return c
+	})
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"time"
+)
+
+type Options struct {
+	// TTL is how long a GetService result is served without asking the registry
+	TTL time.Duration
+	// RefreshInterval is how often cached services are refreshed in the background
+	RefreshInterval time.Duration
+	// IdleTimeout is how long a service is kept without being read
+	IdleTimeout time.Duration
+	// StaleHandler is called whenever a stale result is served because the registry failed
+	StaleHandler func(service string, lastUpdate time.Time, err error)
+}
+
+type Option func(o *Options)
+
+// WithTTL sets the cache TTL, defaults to one minute. A TTL that isn't
+// positive uses the default.
+func WithTTL(t time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = t
+	}
+}
+
+// WithRefreshInterval sets the background refresh interval, defaults to half the TTL.
+func WithRefreshInterval(t time.Duration) Option {
+	return func(o *Options) {
+		o.RefreshInterval = t
+	}
+}
+
+// WithIdleTimeout drops services that haven't been read for t, defaults to
+// ten minutes.
+func WithIdleTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		o.IdleTimeout = t
+	}
+}
+
+// WithStaleHandler reports each stale result, for logs or metrics.
+func WithStaleHandler(fn func(service string, lastUpdate time.Time, err error)) Option {
+	return func(o *Options) {
+		o.StaleHandler = fn
+	}
+}
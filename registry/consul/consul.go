@@ -1,16 +1,21 @@
 package consul
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	consul "github.com/hashicorp/consul/api"
 	hash "github.com/mitchellh/hashstructure"
+
+	"github.com/robert-pkg/base4go/log"
 	"github.com/robert-pkg/base4go/registry"
 )
 
@@ -18,13 +23,28 @@ type consulRegistry struct {
 	Address []string
 	opts    registry.Options
 
-	client *consul.Client
-	config *consul.Config
+	config   *consul.Config
+	encoding EncodingMode
+
+	// 当前使用的 agent, 出现传输错误时切换到下一个地址
+	mu           sync.RWMutex
+	client       *consul.Client
+	addrIndex    int
+	failovers    int
+	nextFailover time.Time
 
 	sync.Mutex
+	// node id -> hash of the registered service
 	register map[string]uint64
 }
 
+// nodeRegisterOptions 是解析后的注册参数, 对每个节点都相同
+type nodeRegisterOptions struct {
+	TTL       time.Duration
+	TCPCheck  *consul.AgentServiceCheck
+	HTTPCheck *consul.AgentServiceCheck
+}
+
 func configure(c *consulRegistry, opts ...registry.Option) {
 	// set opts
 	for _, o := range opts {
@@ -36,8 +56,35 @@ func configure(c *consulRegistry, opts ...registry.Option) {
 
 	if c.opts.Context != nil {
 		// Use the consul config passed in the options, if available
-		if co, ok := c.opts.Context.Value(consulConfigKey).(*consul.Config); ok {
-			config = co
+		// 复制一份, 下面的选项不修改调用方的配置
+		if co, ok := c.opts.Context.Value(consulConfigKey).(*consul.Config); ok && co != nil {
+			cp := *co
+			config = &cp
+		}
+
+		if v, ok := c.opts.Context.Value(consulTokenKey).(string); ok && v != "" {
+			config.Token = v
+		}
+
+		if v, ok := c.opts.Context.Value(consulTLSConfigKey).(consul.TLSConfig); ok {
+			config.Scheme = "https"
+			config.TLSConfig = v
+		}
+
+		if v, ok := c.opts.Context.Value(consulDatacenterKey).(string); ok && v != "" {
+			config.Datacenter = v
+		}
+
+		if v, ok := c.opts.Context.Value(consulNamespaceKey).(string); ok && v != "" {
+			config.Namespace = v
+		}
+
+		if v, ok := c.opts.Context.Value(consulPartitionKey).(string); ok && v != "" {
+			config.Partition = v
+		}
+
+		if v, ok := c.opts.Context.Value(consulEncodingKey).(EncodingMode); ok {
+			c.encoding = v
 		}
 	}
 
@@ -64,19 +111,39 @@ func configure(c *consulRegistry, opts ...registry.Option) {
 	}
 
 	if config.HttpClient == nil {
-		config.HttpClient = new(http.Client)
+		if config.Scheme == "https" {
+			// https needs the tls settings on the transport
+			if config.Transport == nil {
+				config.Transport = http.DefaultTransport.(*http.Transport).Clone()
+			}
+
+			hc, err := consul.NewHttpClient(config.Transport, config.TLSConfig)
+			if err != nil {
+				log.Errorf("consul tls config err: %v", err)
+				hc = new(http.Client)
+			}
+			config.HttpClient = hc
+		} else {
+			config.HttpClient = new(http.Client)
+		}
 	}
 
-	// set timeout
+	// set timeout, on a copy of the http client which may be the caller's
 	if c.opts.Timeout > 0 {
-		config.HttpClient.Timeout = c.opts.Timeout
+		hc := *config.HttpClient
+		hc.Timeout = c.opts.Timeout
+		config.HttpClient = &hc
 	}
 
 	// set the config
 	c.config = config
 
 	// remove client
+	c.mu.Lock()
 	c.client = nil
+	c.failovers = 0
+	c.nextFailover = time.Time{}
+	c.mu.Unlock()
 
 	// setup the client
 	c.Client()
@@ -101,42 +168,55 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 		o(&reg_options)
 	}
 
-	var regTCPCheck bool
-	var regHTTPCheck bool
-	var tcpCheckConfig consul.AgentServiceCheck
-	var httpCheckConfig consul.AgentServiceCheck
+	regOpts := nodeRegisterOptions{TTL: reg_options.TTL}
 	if reg_options.Context != nil {
 		if v, ok := reg_options.Context.Value(consulTCPCheckKey).(consul.AgentServiceCheck); ok {
-			regTCPCheck = true
-			tcpCheckConfig = v
-			reg_options.TTL = 0
+			regOpts.TCPCheck = &v
+			regOpts.TTL = 0
 		}
 		if v, ok := reg_options.Context.Value(consulHTTPCheckConfigKey).(consul.AgentServiceCheck); ok {
-			regHTTPCheck = true
-			httpCheckConfig = v
-			reg_options.TTL = 0
+			regOpts.HTTPCheck = &v
+			regOpts.TTL = 0
+		}
+	}
+
+	var gerr error
+
+	// register each node individually
+	for _, node := range s.Nodes {
+		if err := c.registerNode(s, node, regOpts); err != nil {
+			gerr = err
 		}
 	}
 
-	// create hash of service; uint64
-	h, err := hash.Hash(s, nil)
+	return gerr
+}
+
+func (c *consulRegistry) registerNode(s *registry.Service, node *registry.Node, opts nodeRegisterOptions) error {
+	client := c.Client()
+
+	// the service as seen by this node; uint64
+	h, err := hash.Hash(&registry.Service{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  s.Metadata,
+		Endpoints: s.Endpoints,
+		Nodes:     []*registry.Node{node},
+	}, nil)
 	if err != nil {
 		return err
 	}
 
-	// use first node
-	node := s.Nodes[0]
-
 	// get existing hash and last checked time
 	c.Lock()
-	v, ok := c.register[s.Name]
+	v, ok := c.register[node.Id]
 	c.Unlock()
 
 	// if it's already registered and matches then just pass the check
 	if ok && v == h {
-		if reg_options.TTL == time.Duration(0) {
-			services, _, err := c.Client().Health().Checks(s.Name, &consul.QueryOptions{})
-			if err == nil {
+		if opts.TTL == time.Duration(0) {
+			services, _, err := client.Health().Checks(s.Name, &consul.QueryOptions{})
+			if c.checkErr(client, err) == nil {
 				for _, v := range services {
 					if v.ServiceID == node.Id {
 						return nil
@@ -146,20 +226,31 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 		} else {
 			// if the err is nil we're all good, bail out
 			// if not, we don't know what the state is, so full re-register
-			if err := c.Client().Agent().PassTTL("service:"+node.Id, ""); err == nil {
+			if err := c.checkErr(client, client.Agent().PassTTL("service:"+node.Id, "")); err == nil {
 				return nil
 			}
 		}
 	}
 
-	// encode the tags
-	tags := encodeVersion("v", s.Version)
-	if len(s.Metadata) > 0 {
-		tags = append(tags, encodeMetadata("sm", s.Metadata)...)
-	}
+	var tags []string
+	var meta map[string]string
+	if c.encoding == EncodingMeta {
+		tags, meta = encodeMeta(s, node)
+		if err := validateMeta(meta); err != nil {
+			return err
+		}
+	} else {
+		// encode the tags
+		tags = encodeVersion("v", s.Version)
+		if len(s.Metadata) > 0 {
+			tags = append(tags, encodeMetadata("sm", s.Metadata)...)
+		}
+
+		if len(node.Metadata) > 0 {
+			tags = append(tags, encodeMetadata("nm", node.Metadata)...)
+		}
 
-	if len(node.Metadata) > 0 {
-		tags = append(tags, encodeMetadata("nm", node.Metadata)...)
+		meta = s.Metadata
 	}
 
 	if len(s.Endpoints) > 0 {
@@ -167,15 +258,19 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 	}
 
 	var check *consul.AgentServiceCheck
-	if regTCPCheck {
-		check = &tcpCheckConfig
-	} else if regHTTPCheck {
-		check = &httpCheckConfig
-	} else if reg_options.TTL > time.Duration(0) {
-		deregTTL := getDeregisterTTL(reg_options.TTL)
+	if opts.TCPCheck != nil {
+		tcpCheck := *opts.TCPCheck
+		if tcpCheck.TCP == "" {
+			tcpCheck.TCP = node.Address
+		}
+		check = &tcpCheck
+	} else if opts.HTTPCheck != nil {
+		check = opts.HTTPCheck
+	} else if opts.TTL > time.Duration(0) {
+		deregTTL := getDeregisterTTL(opts.TTL)
 
 		check = &consul.AgentServiceCheck{
-			TTL:                            fmt.Sprintf("%v", reg_options.TTL),
+			TTL:                            fmt.Sprintf("%v", opts.TTL),
 			DeregisterCriticalServiceAfter: fmt.Sprintf("%v", deregTTL),
 		}
 	} else {
@@ -195,26 +290,26 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 		Tags:    tags,
 		Port:    port,
 		Address: host,
-		Meta:    s.Metadata,
+		Meta:    meta,
 		Check:   check,
 	}
 
-	if err := c.Client().Agent().ServiceRegister(asr); err != nil {
+	if err := c.checkErr(client, client.Agent().ServiceRegister(asr)); err != nil {
 		return err
 	}
 
 	// save our hash and time check of the service
 	c.Lock()
-	c.register[s.Name] = h
+	c.register[node.Id] = h
 	c.Unlock()
 
 	// if the TTL is 0 we don't mess with the checks
-	if reg_options.TTL == time.Duration(0) {
+	if opts.TTL == time.Duration(0) {
 		return nil
 	}
 
 	// pass the healthcheck
-	return c.Client().Agent().PassTTL("service:"+node.Id, "")
+	return c.checkErr(client, client.Agent().PassTTL("service:"+node.Id, ""))
 }
 
 func (c *consulRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
@@ -222,56 +317,142 @@ func (c *consulRegistry) Deregister(s *registry.Service, opts ...registry.Deregi
 		return errors.New("require at least one node")
 	}
 
-	// delete our hash and time check of the service
-	c.Lock()
-	delete(c.register, s.Name)
-	c.Unlock()
+	var gerr error
+	for _, node := range s.Nodes {
+		// delete our hash and time check of the service
+		c.Lock()
+		delete(c.register, node.Id)
+		c.Unlock()
+
+		client := c.Client()
+		if err := c.checkErr(client, client.Agent().ServiceDeregister(node.Id)); err != nil {
+			gerr = err
+		}
+	}
 
-	node := s.Nodes[0]
-	return c.Client().Agent().ServiceDeregister(node.Id)
+	return gerr
 }
 
-func (c *consulRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+// getServiceOptions 是 GetService 的参数
+type getServiceOptions struct {
+	passingOnly     bool
+	includeCritical bool
+	queryOptions    *consul.QueryOptions
+	resultFn        func(*consul.QueryMeta)
+	healthFn        func(map[string]string)
+}
 
+func newGetServiceOptions(opts ...registry.GetOption) getServiceOptions {
 	var options registry.GetOptions
 	for _, o := range opts {
 		o(&options)
 	}
 
-	passingOnly := false
-	var queryOptions *consul.QueryOptions
-	var resultFn func(*consul.QueryMeta)
+	var g getServiceOptions
 	if options.Context != nil {
 		if v, ok := options.Context.Value(consulPassingOnlyKey).(bool); ok {
-			passingOnly = v
+			g.passingOnly = v
+		}
+
+		if v, ok := options.Context.Value(consulIncludeCriticalKey).(bool); ok {
+			g.includeCritical = v
 		}
 
 		if v, ok := options.Context.Value(consulQueryOptionsKey).(*consul.QueryOptions); ok && v != nil {
-			queryOptions = v
+			g.queryOptions = v
 		}
 
 		if v, ok := options.Context.Value(consulGetServiceResultOptionsKey).(func(*consul.QueryMeta)); ok && v != nil {
-			resultFn = v
+			g.resultFn = v
+		}
+
+		if v, ok := options.Context.Value(consulHealthResultKey).(func(map[string]string)); ok && v != nil {
+			g.healthFn = v
 		}
 	}
 
-	if queryOptions == nil {
-		queryOptions = &consul.QueryOptions{
+	if g.queryOptions == nil {
+		g.queryOptions = &consul.QueryOptions{
 			AllowStale: true,
 		}
 	}
 
-	rsp, queryMeta, err := c.Client().Health().Service(name, "", passingOnly, queryOptions)
-	if err != nil {
+	return g
+}
+
+// CacheKey implements cache.Keyer, the result of GetService depends on the
+// datacenter, namespace, partition, filter and the health options.
+func (c *consulRegistry) CacheKey(opts ...registry.GetOption) string {
+	g := newGetServiceOptions(opts...)
+	q := g.queryOptions
+
+	return fmt.Sprintf("dc=%s&ns=%s&ap=%s&filter=%s&passing=%t&critical=%t",
+		q.Datacenter, q.Namespace, q.Partition, q.Filter, g.passingOnly, g.includeCritical)
+}
+
+func (c *consulRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	g := newGetServiceOptions(opts...)
+
+	client := c.Client()
+	rsp, queryMeta, err := client.Health().Service(name, "", g.passingOnly, g.queryOptions)
+	if err := c.checkErr(client, err); err != nil {
+		return nil, err
+	}
+
+	// passingOnly 时 consul 已经过滤, 否则除非要求返回全部节点, 跳过 critical 节点
+	services := buildServices(name, rsp, !g.passingOnly && !g.includeCritical)
+
+	if g.healthFn != nil {
+		health := make(map[string]string, len(rsp))
+		for _, e := range rsp {
+			if e.Service.Service == name {
+				health[e.Service.ID] = e.Checks.AggregatedStatus()
+			}
+		}
+		g.healthFn(health)
+	}
+
+	if g.resultFn != nil {
+		g.resultFn(queryMeta)
+	}
+	return services, nil
+}
+
+func (c *consulRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	client := c.Client()
+	rsp, _, err := client.Catalog().Services(&consul.QueryOptions{})
+	if err := c.checkErr(client, err); err != nil {
 		return nil, err
 	}
 
-	services := make([]*registry.Service, 0, len(rsp))
+	var services []*registry.Service
+
+	for service := range rsp {
+		services = append(services, &registry.Service{Name: service})
+	}
+
+	return services, nil
+}
+
+func (c *consulRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newConsulWatcher(c, opts...)
+}
+
+// buildServices 把 consul 的查询结果按版本聚合, 每个版本一个 Service, 节点按 Id 排序.
+// skipCritical 为 true 时, 跳过存在 critical 检查的节点.
+func buildServices(name string, rsp []*consul.ServiceEntry, skipCritical bool) []*registry.Service {
+	serviceMap := make(map[string]*registry.Service)
+	var services []*registry.Service
+
 	for _, s := range rsp {
 		if s.Service.Service != name {
 			continue
 		}
 
+		if skipCritical && isCritical(s.Checks) {
+			continue
+		}
+
 		// address is service address
 		address := s.Service.Address
 
@@ -280,105 +461,194 @@ func (c *consulRegistry) GetService(name string, opts ...registry.GetOption) ([]
 			address = s.Node.Address
 		}
 
-		if !passingOnly {
-			var del bool
-			for _, check := range s.Checks {
-				// delete the node if the status is critical
-				//	HealthAny      = "any"
-				//HealthPassing  = "passing"
-				//HealthWarning  = "warning"
-				//HealthCritical = "critical"
-				//HealthMaint    = "maintenance"
-				if check.Status == consul.HealthCritical { // passing, warning,critical,maintenance
-					del = true
-					break
-				}
-			}
+		version := decodeServiceVersion(s.Service)
 
-			// if delete then skip the node
-			if del {
-				continue
+		svc, ok := serviceMap[version]
+		if !ok {
+			svc = &registry.Service{
+				Endpoints: decodeEndpoints(s.Service.Tags),
+				Name:      s.Service.Service,
+				Version:   version,
+				Metadata:  decodeServiceMetadata(s.Service),
 			}
+			serviceMap[version] = svc
+			services = append(services, svc)
 		}
 
-		// version is now a tag
-		version, _ := decodeVersion("v", s.Service.Tags)
-		// service ID is now the node id
-		id := s.Service.ID
-
-		svc := &registry.Service{
-			Endpoints: decodeEndpoints(s.Service.Tags),
-			Name:      s.Service.Service,
-			Version:   version,
-			Nodes: []*registry.Node{
-				&registry.Node{
-					Id:       id,
-					Address:  fmt.Sprintf("%s:%d", address, s.Service.Port),
-					Metadata: decodeMetadata("nm", s.Service.Tags),
-				},
-			},
-		}
-
-		services = append(services, svc)
+		svc.Nodes = append(svc.Nodes, &registry.Node{
+			// service ID is now the node id
+			Id:       s.Service.ID,
+			Address:  fmt.Sprintf("%s:%d", address, s.Service.Port),
+			Metadata: decodeNodeMetadata(s.Service),
+		})
 	}
 
-	if resultFn != nil {
-		resultFn(queryMeta)
+	for _, svc := range services {
+		sort.Slice(svc.Nodes, func(i, j int) bool {
+			return svc.Nodes[i].Id < svc.Nodes[j].Id
+		})
 	}
-	return services, nil
+
+	return services
 }
 
-func (c *consulRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
-	rsp, _, err := c.Client().Catalog().Services(&consul.QueryOptions{})
-	if err != nil {
-		return nil, err
+func isCritical(checks consul.HealthChecks) bool {
+	for _, check := range checks {
+		if check.Status == consul.HealthCritical {
+			return true
+		}
 	}
+	return false
+}
 
-	var services []*registry.Service
-
-	for service := range rsp {
-		services = append(services, &registry.Service{Name: service})
+// Client returns the client of the active agent, it is never nil.
+func (c *consulRegistry) Client() *consul.Client {
+	c.mu.RLock()
+	client := c.client
+	c.mu.RUnlock()
+	if client != nil {
+		return client
 	}
 
-	return services, nil
-}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-func (c *consulRegistry) Client() *consul.Client {
 	if c.client != nil {
 		return c.client
 	}
 
-	for _, addr := range c.Address {
-		// set the address
-		c.config.Address = addr
-
+	for i, addr := range c.Address {
 		// create a new client
-		tmpClient, _ := consul.NewClient(c.config)
+		tmpClient, err := c.newClient(addr)
+		if err != nil {
+			continue
+		}
 
 		// test the client
-		_, err := tmpClient.Agent().Host()
-		if err != nil {
+		if _, err := tmpClient.Agent().Host(); err != nil {
 			continue
 		}
 
 		// set the client
 		c.client = tmpClient
+		c.addrIndex = i
 		return c.client
 	}
 
-	// set the default
+	// no agent responded, start with the first address and rely on failover
+	addr := c.config.Address
+	if len(c.Address) > 0 {
+		addr = c.Address[0]
+	}
+	c.addrIndex = 0
+
 	var err error
-	c.client, err = consul.NewClient(c.config)
+	c.client, err = c.newClient(addr)
 	if err != nil {
-		// Log the error but return nil - caller should handle
-		// This maintains backward compatibility while surfacing the error
-		return nil
+		log.Errorf("consul new client. addr:%s err:%v", addr, err)
+		c.client, _ = consul.NewClient(consul.DefaultNonPooledConfig())
 	}
 
-	// return the client
 	return c.client
 }
 
+// ActiveAddress returns the address of the agent currently in use.
+func (c *consulRegistry) ActiveAddress() string {
+	c.Client()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.addrIndex < len(c.Address) {
+		return c.Address[c.addrIndex]
+	}
+	return c.config.Address
+}
+
+func (c *consulRegistry) newClient(addr string) (*consul.Client, error) {
+	config := *c.config
+	config.Address = addr
+	return consul.NewClient(&config)
+}
+
+// checkErr 在 client 出现传输错误时切换到下一个 agent, 原样返回 err
+func (c *consulRegistry) checkErr(client *consul.Client, err error) error {
+	if err == nil {
+		c.mu.RLock()
+		failed := c.failovers > 0 && c.client == client
+		c.mu.RUnlock()
+
+		if failed {
+			c.mu.Lock()
+			c.failovers = 0
+			c.nextFailover = time.Time{}
+			c.mu.Unlock()
+		}
+		return nil
+	}
+
+	if len(c.Address) < 2 || !isTransportError(err) {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 其他调用已经切换过了
+	if c.client != client {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(c.nextFailover) {
+		return err
+	}
+
+	next := (c.addrIndex + 1) % len(c.Address)
+	tmpClient, nerr := c.newClient(c.Address[next])
+	if nerr != nil {
+		return err
+	}
+
+	log.Errorf("consul agent %s err:%v, failover to %s", c.Address[c.addrIndex], err, c.Address[next])
+
+	c.client = tmpClient
+	c.addrIndex = next
+	c.failovers++
+	c.nextFailover = now.Add(failoverBackoff(c.failovers, len(c.Address)))
+
+	return err
+}
+
+// failoverBackoff 第一轮立即切换, 之后每轮所有地址都失败时等待时间翻倍, 最长 30 秒
+func failoverBackoff(failovers, addrs int) time.Duration {
+	rounds := failovers / addrs
+	if rounds == 0 {
+		return 0
+	}
+
+	d := time.Second << uint(rounds-1)
+	if d > 30*time.Second || d <= 0 {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+// isTransportError 判断是否连不上 agent. consul 返回的错误状态码, 以及调用方取消或超时都不算.
+func isTransportError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return true
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
 func (c *consulRegistry) String() string {
 	return "consul"
 }
@@ -0,0 +1,460 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/internal/testutil/consultest"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/cache"
+	"github.com/robert-pkg/base4go/registry/registrytest"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func testEntry(id, version string, port int, status string) *consul.ServiceEntry {
+	tags := encodeVersion("v", version)
+	tags = append(tags, encodeMetadata("sm", map[string]string{"owner": "base4go"})...)
+	tags = append(tags, encodeMetadata("nm", map[string]string{"id": id})...)
+
+	return &consul.ServiceEntry{
+		Node: &consul.Node{Address: "10.0.0.1"},
+		Service: &consul.AgentService{
+			ID:      id,
+			Service: "Greeter",
+			Port:    port,
+			Tags:    tags,
+		},
+		Checks: consul.HealthChecks{{Status: status}},
+	}
+}
+
+func TestBuildServices(t *testing.T) {
+	rsp := []*consul.ServiceEntry{
+		testEntry("b", "v1", 8001, consul.HealthPassing),
+		testEntry("a", "v1", 8000, consul.HealthPassing),
+		testEntry("c", "v2", 8002, consul.HealthPassing),
+		testEntry("d", "v2", 8003, consul.HealthCritical),
+	}
+
+	services := buildServices("Greeter", rsp, true)
+	if len(services) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(services))
+	}
+
+	v1 := services[0]
+	if v1.Version != "v1" || len(v1.Nodes) != 2 {
+		t.Fatalf("expected v1 with 2 nodes, got %s with %d nodes", v1.Version, len(v1.Nodes))
+	}
+	if v1.Nodes[0].Id != "a" || v1.Nodes[0].Address != "10.0.0.1:8000" {
+		t.Errorf("unexpected first node: %+v", v1.Nodes[0])
+	}
+	if v1.Nodes[1].Metadata["id"] != "b" {
+		t.Errorf("node metadata not decoded: %v", v1.Nodes[1].Metadata)
+	}
+	if v1.Metadata["owner"] != "base4go" {
+		t.Errorf("service metadata not decoded: %v", v1.Metadata)
+	}
+
+	if v2 := services[1]; len(v2.Nodes) != 1 {
+		t.Errorf("expected critical node to be skipped, got %d nodes", len(v2.Nodes))
+	}
+
+	all := buildServices("Greeter", rsp, false)
+	if v2 := all[1]; len(v2.Nodes) != 2 {
+		t.Errorf("expected critical node to be kept, got %d nodes", len(v2.Nodes))
+	}
+}
+
+func TestDecodeServiceMetadataFromMeta(t *testing.T) {
+	md := decodeServiceMetadata(&consul.AgentService{
+		Meta: map[string]string{"owner": "base4go"},
+	})
+	if md["owner"] != "base4go" {
+		t.Errorf("expected metadata from Meta, got %v", md)
+	}
+
+	// 旧的注册方式, 服务元数据中有 version 键
+	s := &consul.AgentService{
+		Tags: encodeVersion("v", "v1.0.0"),
+		Meta: map[string]string{"version": "2", "owner": "base4go"},
+	}
+	if md := decodeServiceMetadata(s); len(md) != 2 || md["version"] != "2" {
+		t.Errorf("expected legacy metadata from Meta, got %v", md)
+	}
+	if v := decodeServiceVersion(s); v != "v1.0.0" {
+		t.Errorf("expected version from the tag, got %s", v)
+	}
+}
+
+func TestConfigureOptions(t *testing.T) {
+	c := newConsulRegistry(
+		Token("secret"),
+		Datacenter("dc2"),
+		Namespace("ns1"),
+		Partition("part1"),
+		TLSConfig(consul.TLSConfig{InsecureSkipVerify: true}),
+	)
+
+	if c.config.Token != "secret" {
+		t.Errorf("token not applied: %q", c.config.Token)
+	}
+	if c.config.Datacenter != "dc2" {
+		t.Errorf("datacenter not applied: %q", c.config.Datacenter)
+	}
+	if c.config.Namespace != "ns1" || c.config.Partition != "part1" {
+		t.Errorf("namespace/partition not applied: %q %q", c.config.Namespace, c.config.Partition)
+	}
+	if c.config.Scheme != "https" {
+		t.Errorf("expected https scheme, got %q", c.config.Scheme)
+	}
+	if tr, ok := c.config.HttpClient.Transport.(*http.Transport); !ok || tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("tls config not applied to the http client")
+	}
+}
+
+func TestConfigureCopiesConfig(t *testing.T) {
+	hc := &http.Client{}
+	co := &consul.Config{Address: "127.0.0.1:8500", HttpClient: hc}
+
+	c := newConsulRegistry(
+		Config(co),
+		Token("secret"),
+		Datacenter("dc2"),
+		TLSConfig(consul.TLSConfig{InsecureSkipVerify: true}),
+		registry.Timeout(time.Second),
+	)
+
+	if c.config.Token != "secret" || c.config.Datacenter != "dc2" || c.config.HttpClient.Timeout != time.Second {
+		t.Errorf("options not applied: %+v", c.config)
+	}
+	if co.Token != "" || co.Datacenter != "" || co.Scheme != "" || co.TLSConfig.InsecureSkipVerify {
+		t.Errorf("caller's config modified: %+v", co)
+	}
+	if co.HttpClient != hc || hc.Timeout != 0 {
+		t.Errorf("caller's http client modified: %+v", hc)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	first := consultest.NewServer(t)
+	second := consultest.NewServer(t)
+	firstAddr := first.Addr()
+	secondAddr := second.Addr()
+
+	c := newConsulRegistry(registry.Addrs(firstAddr, secondAddr))
+	if addr := c.ActiveAddress(); addr != firstAddr {
+		t.Fatalf("expected %s to be active, got %s", firstAddr, addr)
+	}
+
+	first.Close()
+
+	// the first call fails on the dead agent and rotates
+	if _, err := c.GetService("Greeter"); err == nil {
+		t.Fatal("expected a transport error from the dead agent")
+	}
+	if addr := c.ActiveAddress(); addr != secondAddr {
+		t.Fatalf("expected failover to %s, got %s", secondAddr, addr)
+	}
+
+	if _, err := c.GetService("Greeter"); err != nil {
+		t.Errorf("expected the second agent to serve, got %v", err)
+	}
+}
+
+func TestCacheWithOptions(t *testing.T) {
+	srv := consultest.NewServer(t)
+	r := NewRegistry(registry.Addrs(srv.Addr()))
+	if _, ok := r.(cache.Keyer); !ok {
+		t.Fatal("consul registry should implement cache.Keyer")
+	}
+
+	err := r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "a", Address: "127.0.0.1:9000"}},
+	})
+	if err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	c := cache.New(r)
+	defer c.Stop()
+
+	dc := func(name string) []registry.GetOption {
+		return []registry.GetOption{
+			PassingOnly(true),
+			QueryOptionsForGetService(&consul.QueryOptions{Datacenter: name}),
+		}
+	}
+
+	if ss, err := c.GetService("Greeter", dc("")...); err != nil || len(ss) != 1 {
+		t.Fatalf("get service: %+v %v", ss, err)
+	}
+
+	// agent 不可用时, 带参数的调用返回相同参数的上一次结果
+	srv.Close()
+	if ss, err := c.GetService("Greeter", dc("")...); err != nil || len(ss) != 1 || ss[0].Nodes[0].Id != "a" {
+		t.Errorf("expected the stale result, got %+v %v", ss, err)
+	}
+	if _, err := c.GetService("Greeter", dc("dc2")...); err == nil {
+		t.Error("expected an error for another datacenter")
+	}
+}
+
+// registerHealth 注册健康的节点 a 和 critical 的节点 b
+func registerHealth(t *testing.T, c *consulRegistry) {
+	t.Helper()
+
+	for _, id := range []string{"a", "b"} {
+		err := c.Register(&registry.Service{
+			Name:    "Greeter",
+			Version: "v1",
+			Nodes:   []*registry.Node{{Id: id, Address: "127.0.0.1:9000"}},
+		}, registry.RegisterTTL(time.Minute))
+		if err != nil {
+			t.Fatalf("register %s err: %v", id, err)
+		}
+	}
+
+	if err := c.Client().Agent().FailTTL("service:b", ""); err != nil {
+		t.Fatalf("fail ttl err: %v", err)
+	}
+}
+
+func nodeIds(services []*registry.Service) []string {
+	var ids []string
+	for _, s := range services {
+		for _, n := range s.Nodes {
+			ids = append(ids, n.Id)
+		}
+	}
+	return ids
+}
+
+func TestGetServiceHealth(t *testing.T) {
+	c := newConsulRegistry(registry.Addrs(consultest.NewServer(t).Addr()))
+	registerHealth(t, c)
+
+	tests := []struct {
+		name string
+		opts []registry.GetOption
+		ids  []string
+	}{
+		{"default", nil, []string{"a"}},
+		{"include critical", []registry.GetOption{IncludeCritical(true)}, []string{"a", "b"}},
+		{"passing only", []registry.GetOption{PassingOnly(true)}, []string{"a"}},
+		{"passing only include critical", []registry.GetOption{PassingOnly(true), IncludeCritical(true)}, []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		ss, err := c.GetService("Greeter", tt.opts...)
+		if err != nil {
+			t.Fatalf("%s: get service err: %v", tt.name, err)
+		}
+		if ids := nodeIds(ss); !slices.Equal(ids, tt.ids) {
+			t.Errorf("%s: expected nodes %v, got %v", tt.name, tt.ids, ids)
+		}
+	}
+
+	var health map[string]string
+	ss, err := c.GetService("Greeter", HealthResult(func(h map[string]string) { health = h }))
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if ids := nodeIds(ss); !slices.Equal(ids, []string{"a"}) {
+		t.Errorf("expected nodes [a], got %v", ids)
+	}
+	if len(health) != 2 || health["a"] != consul.HealthPassing || health["b"] != consul.HealthCritical {
+		t.Errorf("unexpected health: %v", health)
+	}
+}
+
+func TestWatchSkipsCritical(t *testing.T) {
+	c := newConsulRegistry(registry.Addrs(consultest.NewServer(t).Addr()))
+	registerHealth(t, c)
+
+	w, err := c.Watch(registry.WatchService("Greeter"))
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	defer w.Stop()
+
+	next := func() *registry.Result {
+		t.Helper()
+
+		ch := make(chan *registry.Result, 1)
+		errCh := make(chan error, 1)
+		go func() {
+			r, err := w.Next()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			ch <- r
+		}()
+
+		select {
+		case r := <-ch:
+			return r
+		case err := <-errCh:
+			t.Fatalf("next err: %v", err)
+			return nil
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for a watch result")
+			return nil
+		}
+	}
+
+	r := next()
+	if r.Action != registry.Create.String() || !slices.Equal(nodeIds([]*registry.Service{r.Service}), []string{"a"}) {
+		t.Fatalf("expected create with node a, got %s %v", r.Action, nodeIds([]*registry.Service{r.Service}))
+	}
+
+	// b 恢复健康后出现在节点列表里
+	if err := c.Client().Agent().PassTTL("service:b", ""); err != nil {
+		t.Fatalf("pass ttl err: %v", err)
+	}
+	r = next()
+	if r.Action != registry.Update.String() || !slices.Equal(nodeIds([]*registry.Service{r.Service}), []string{"a", "b"}) {
+		t.Errorf("expected update with nodes a, b, got %s %v", r.Action, nodeIds([]*registry.Service{r.Service}))
+	}
+}
+
+func TestEncodingMeta(t *testing.T) {
+	s := &registry.Service{
+		Name:      "Greeter",
+		Version:   "v1.0.0",
+		Metadata:  map[string]string{"owner": "base4go"},
+		Endpoints: []*registry.Endpoint{{Name: "Greeter.Echo"}},
+	}
+	node := &registry.Node{Id: "a", Address: "10.0.0.1:8000", Metadata: map[string]string{"env": "prod"}}
+
+	tags, meta := encodeMeta(s, node)
+	tags = append(tags, encodeEndpoints("e", s.Endpoints)...)
+
+	if meta["base4go_encoding"] != "meta" || meta["version"] != "v1.0.0" || meta["nm_env"] != "prod" || meta["sm_owner"] != "base4go" {
+		t.Errorf("unexpected meta: %v", meta)
+	}
+
+	services := buildServices("Greeter", []*consul.ServiceEntry{{
+		Node:    &consul.Node{Address: "10.0.0.1"},
+		Service: &consul.AgentService{ID: "a", Service: "Greeter", Port: 8000, Tags: tags, Meta: meta},
+	}}, true)
+
+	if len(services) != 1 {
+		t.Fatalf("expected 1 service, got %d", len(services))
+	}
+	svc := services[0]
+	if svc.Version != "v1.0.0" || svc.Metadata["owner"] != "base4go" {
+		t.Errorf("unexpected service: %+v", svc)
+	}
+	if svc.Nodes[0].Metadata["env"] != "prod" {
+		t.Errorf("unexpected node metadata: %v", svc.Nodes[0].Metadata)
+	}
+	if len(svc.Endpoints) != 1 || svc.Endpoints[0].Name != "Greeter.Echo" {
+		t.Errorf("unexpected endpoints: %+v", svc.Endpoints)
+	}
+}
+
+func TestEncodingMetaReservedKeys(t *testing.T) {
+	s := &registry.Service{
+		Name:      "Greeter",
+		Version:   "v1.0.0",
+		Endpoints: []*registry.Endpoint{{Name: "Greeter.Echo"}},
+	}
+	node := &registry.Node{Id: "a", Address: "10.0.0.1:8000", Metadata: map[string]string{
+		"e": "x", "e-1": "x", "v-1": "x", "nm-1": "x", "version": "x", "gray": "true",
+	}}
+
+	tags, meta := encodeMeta(s, node)
+	tags = append(tags, encodeEndpoints("e", s.Endpoints)...)
+
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "e=") || strings.HasPrefix(tag, "v-1") || tag == "version=x" {
+			t.Errorf("reserved key should not be a readable tag: %s", tag)
+		}
+	}
+	if !slices.Contains(tags, "gray=true") {
+		t.Errorf("expected readable tag gray=true, got %v", tags)
+	}
+
+	services := buildServices("Greeter", []*consul.ServiceEntry{{
+		Node:    &consul.Node{Address: "10.0.0.1"},
+		Service: &consul.AgentService{ID: "a", Service: "Greeter", Port: 8000, Tags: tags, Meta: meta},
+	}}, true)
+
+	svc := services[0]
+	if svc.Version != "v1.0.0" || len(svc.Endpoints) != 1 || svc.Endpoints[0].Name != "Greeter.Echo" {
+		t.Errorf("unexpected service: %+v", svc)
+	}
+	if md := svc.Nodes[0].Metadata; len(md) != 6 || md["e"] != "x" || md["version"] != "x" {
+		t.Errorf("unexpected node metadata: %v", md)
+	}
+}
+
+func TestValidateMeta(t *testing.T) {
+	many := make(map[string]string)
+	for i := 0; i <= metaMaxPairs; i++ {
+		many[fmt.Sprintf("k%d", i)] = "v"
+	}
+
+	tests := []struct {
+		meta map[string]string
+		err  bool
+	}{
+		{meta: map[string]string{"version": "v1", "nm_gray": "true", "sm_owner-id": "a"}},
+		{meta: many, err: true},
+		{meta: map[string]string{strings.Repeat("k", metaKeyMaxLength+1): "v"}, err: true},
+		{meta: map[string]string{"k": strings.Repeat("v", metaValueMaxLength+1)}, err: true},
+		{meta: map[string]string{"nm_zone.name": "a"}, err: true},
+		{meta: map[string]string{"consul-version": "1"}, err: true},
+	}
+
+	for i, tt := range tests {
+		if err := validateMeta(tt.meta); (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected err: %v", i, err)
+		}
+	}
+}
+
+func TestRegisterValidateMeta(t *testing.T) {
+	addr := consultest.NewServer(t).Addr()
+	s := &registry.Service{
+		Name:     "Greeter",
+		Version:  "v1",
+		Metadata: map[string]string{"zone.name": "a"},
+		Nodes:    []*registry.Node{{Id: "a", Address: "127.0.0.1:9000"}},
+	}
+
+	// 旧的编码方式不检查 Meta 的限制
+	if err := NewRegistry(registry.Addrs(addr)).Register(s); err != nil {
+		t.Errorf("tags encoding: unexpected err: %v", err)
+	}
+	if err := NewRegistry(registry.Addrs(addr), Encoding(EncodingMeta)).Register(s); err == nil {
+		t.Error("meta encoding: expected an error for an invalid meta key")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	agent := consultest.NewServer(t)
+	addr := agent.Addr()
+
+	for name, m := range map[string]EncodingMode{"Tags": EncodingTags, "Meta": EncodingMeta} {
+		t.Run(name, func(t *testing.T) {
+			registrytest.RunConformance(t, func() registry.Registry {
+				return NewRegistry(registry.Addrs(addr), Encoding(m))
+			})
+		})
+	}
+}
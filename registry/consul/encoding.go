@@ -5,9 +5,13 @@ import (
 	"compress/zlib"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"regexp"
 	"strings"
 
+	consul "github.com/hashicorp/consul/api"
+
 	"github.com/robert-pkg/base4go/registry"
 )
 
@@ -97,7 +101,8 @@ func decodeEndpoints(tags []string) []*registry.Endpoint {
 	var ver byte
 
 	for _, tag := range tags {
-		if len(tag) == 0 || tag[0] != 'e' {
+		// 只处理 e- 和 e= 开头的标签, 跳过 env=prod 这类可读标签
+		if len(tag) < 2 || tag[0] != 'e' || (tag[1] != '-' && tag[1] != '=') {
 			continue
 		}
 
@@ -144,3 +149,145 @@ func decodeVersion(prefix string, tags []string) (string, bool) {
 
 	return "", false
 }
+
+// EncodingMeta 模式下 Meta 中的键.
+// consul 的 Meta 键只允许字母、数字、- 和 _, 元数据的键需满足同样的限制.
+// 旧的注册方式把服务元数据原样写在 Meta 中, 可能也有 version 键,
+// 所以用单独的 metaEncodingKey 标记 EncodingMeta 模式.
+const (
+	metaEncodingKey    = "base4go_encoding"
+	metaEncodingMeta   = "meta"
+	metaVersionKey     = "version"
+	metaServicePrefix  = "sm_"
+	metaNodePrefix     = "nm_"
+	tagVersionPrefix   = "version="
+	tagMetadataDivider = "="
+)
+
+// encodeMeta 把版本和元数据写入 Meta, 同时生成可读的标签(version=v1.0.0, gray=true),
+// 便于在 consul UI 中查看和按标签过滤.
+func encodeMeta(s *registry.Service, node *registry.Node) ([]string, map[string]string) {
+	tags := []string{tagVersionPrefix + s.Version}
+	meta := map[string]string{
+		metaEncodingKey: metaEncodingMeta,
+		metaVersionKey:  s.Version,
+	}
+
+	for k, v := range s.Metadata {
+		meta[metaServicePrefix+k] = v
+	}
+
+	for k, v := range node.Metadata {
+		meta[metaNodePrefix+k] = v
+		if readableTag(k) {
+			tags = append(tags, k+tagMetadataDivider+v)
+		}
+	}
+
+	return tags, meta
+}
+
+// readableTag 判断元数据的键能否生成可读标签. 解码时 e=... 会被当作旧格式的接口,
+// e-/v-/sm-/nm- 开头会被当作编码后的标签, version=... 与版本标签重复,
+// 这些键只写入 Meta.
+func readableTag(k string) bool {
+	if k == "e" || k == metaVersionKey {
+		return false
+	}
+
+	for _, p := range []string{"e-", "v-", "sm-", "nm-"} {
+		if strings.HasPrefix(k, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// consul 对 Meta 的限制
+const (
+	metaMaxPairs       = 64
+	metaKeyMaxLength   = 128
+	metaValueMaxLength = 512
+	metaReservedPrefix = "consul-"
+)
+
+var metaKeyFormat = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// validateMeta 按 consul 的限制检查 EncodingMeta 模式的 Meta, 在注册前返回明确的错误
+func validateMeta(meta map[string]string) error {
+	if len(meta) > metaMaxPairs {
+		return fmt.Errorf("consul meta has %d keys, at most %d", len(meta), metaMaxPairs)
+	}
+
+	for k, v := range meta {
+		if len(k) > metaKeyMaxLength {
+			return fmt.Errorf("consul meta key %q longer than %d", k, metaKeyMaxLength)
+		}
+		if !metaKeyFormat.MatchString(k) {
+			return fmt.Errorf("consul meta key %q may only contain letters, digits, - and _", k)
+		}
+		if strings.HasPrefix(k, metaReservedPrefix) {
+			return fmt.Errorf("consul meta key %q uses the reserved prefix %q", k, metaReservedPrefix)
+		}
+		if len(v) > metaValueMaxLength {
+			return fmt.Errorf("consul meta value of %q longer than %d", k, metaValueMaxLength)
+		}
+	}
+
+	return nil
+}
+
+// isMetaEncoded 判断服务是否以 EncodingMeta 模式注册
+func isMetaEncoded(meta map[string]string) bool {
+	return meta[metaEncodingKey] == metaEncodingMeta
+}
+
+func decodeMetaPrefix(meta map[string]string, prefix string) map[string]string {
+	md := make(map[string]string)
+	for k, v := range meta {
+		if strings.HasPrefix(k, prefix) {
+			md[k[len(prefix):]] = v
+		}
+	}
+	return md
+}
+
+// decodeServiceVersion 先读旧的 v- 标签, 再读 Meta
+func decodeServiceVersion(s *consul.AgentService) string {
+	if version, ok := decodeVersion("v", s.Tags); ok {
+		return version
+	}
+
+	if !isMetaEncoded(s.Meta) {
+		return ""
+	}
+	return s.Meta[metaVersionKey]
+}
+
+// decodeNodeMetadata 先读旧的 nm- 标签, 再读 Meta
+func decodeNodeMetadata(s *consul.AgentService) map[string]string {
+	md := decodeMetadata("nm", s.Tags)
+	if len(md) > 0 || !isMetaEncoded(s.Meta) {
+		return md
+	}
+
+	return decodeMetaPrefix(s.Meta, metaNodePrefix)
+}
+
+// decodeServiceMetadata 先读旧的 sm- 标签, 再读 Meta
+func decodeServiceMetadata(s *consul.AgentService) map[string]string {
+	md := decodeMetadata("sm", s.Tags)
+	if len(md) > 0 {
+		return md
+	}
+
+	if isMetaEncoded(s.Meta) {
+		return decodeMetaPrefix(s.Meta, metaServicePrefix)
+	}
+
+	// 旧的注册方式把服务元数据原样写在 Meta 中
+	for k, v := range s.Meta {
+		md[k] = v
+	}
+	return md
+}
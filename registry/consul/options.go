@@ -13,6 +13,24 @@ import (
 type contextKey string
 
 const consulConfigKey contextKey = "consul_config"
+const consulTokenKey contextKey = "consul_token"
+const consulTLSConfigKey contextKey = "consul_tls_config"
+const consulDatacenterKey contextKey = "consul_datacenter"
+const consulNamespaceKey contextKey = "consul_namespace"
+const consulPartitionKey contextKey = "consul_partition"
+const consulEncodingKey contextKey = "consul_encoding"
+
+// EncodingMode selects how version and metadata are written when registering.
+// Both modes are always understood when reading.
+type EncodingMode int
+
+const (
+	// EncodingTags writes version and metadata as zlib compressed hex tags (v-, sm-, nm-).
+	EncodingTags EncodingMode = iota
+	// EncodingMeta writes version and metadata into the service Meta,
+	// together with readable tags such as version=v1.0.0 and gray=true.
+	EncodingMeta
+)
 
 // 注册接口的可选参数
 const consulTCPCheckKey contextKey = "consul_tcp_check"
@@ -20,8 +38,10 @@ const consulHTTPCheckConfigKey contextKey = "consul_http_check_config"
 
 // GetService的可选参数
 const consulPassingOnlyKey contextKey = "consul_passing_only"
+const consulIncludeCriticalKey contextKey = "consul_include_critical"
 const consulQueryOptionsKey contextKey = "consul_query_options"
 const consulGetServiceResultOptionsKey contextKey = "consul_get_service_result_options"
+const consulHealthResultKey contextKey = "consul_health_result"
 
 func Config(c *consul.Config) registry.Option {
 	return func(o *registry.Options) {
@@ -32,8 +52,50 @@ func Config(c *consul.Config) registry.Option {
 	}
 }
 
+// Token sets the ACL token used for every request to Consul.
+func Token(token string) registry.Option {
+	return setRegistryOption(consulTokenKey, token)
+}
+
+// TLSConfig enables HTTPS to the Consul agent with the given CA,
+// client certificate and key.
+func TLSConfig(t consul.TLSConfig) registry.Option {
+	return setRegistryOption(consulTLSConfigKey, t)
+}
+
+// Datacenter sets the default datacenter for queries,
+// instead of the datacenter of the local agent.
+func Datacenter(dc string) registry.Option {
+	return setRegistryOption(consulDatacenterKey, dc)
+}
+
+// Namespace sets the Consul Enterprise namespace.
+func Namespace(ns string) registry.Option {
+	return setRegistryOption(consulNamespaceKey, ns)
+}
+
+// Partition sets the Consul Enterprise admin partition.
+func Partition(partition string) registry.Option {
+	return setRegistryOption(consulPartitionKey, partition)
+}
+
+// Encoding selects the EncodingMode used by Register, defaults to EncodingTags.
+func Encoding(m EncodingMode) registry.Option {
+	return setRegistryOption(consulEncodingKey, m)
+}
+
+func setRegistryOption(k, v interface{}) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
 // TCPCheck will tell the service provider to check the service address
 // and port every `t` interval. It will enabled only if `t` is greater than 0.
+// An empty `tcp` checks the address of each registered node.
 // See `TCP + Interval` for more information [1].
 //
 // [1] https://www.consul.io/docs/agent/checks.html
@@ -92,6 +154,17 @@ func PassingOnly(passingOnly bool) registry.GetOption {
 	}
 }
 
+// IncludeCritical returns nodes with failing (critical) checks as well.
+// By default GetService skips them. It has no effect with PassingOnly(true).
+func IncludeCritical(include bool) registry.GetOption {
+	return func(o *registry.GetOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, consulIncludeCriticalKey, include)
+	}
+}
+
 // QueryOptions specifies the QueryOptions to be used when calling
 // Consul. See `Consul API` for more information [1].
 //
@@ -119,3 +192,18 @@ func GetServiceResult(resultFn func(*consul.QueryMeta)) registry.GetOption {
 		o.Context = context.WithValue(o.Context, consulGetServiceResultOptionsKey, resultFn)
 	}
 }
+
+// HealthResult passes the aggregated check status of every node returned by
+// consul, keyed by node id, to resultFn. It's built from the same query as
+// the services, nodes skipped as critical are included.
+func HealthResult(resultFn func(map[string]string)) registry.GetOption {
+	return func(o *registry.GetOptions) {
+		if resultFn == nil {
+			return
+		}
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, consulHealthResultKey, resultFn)
+	}
+}
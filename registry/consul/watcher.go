@@ -0,0 +1,285 @@
+package consul
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	hash "github.com/mitchellh/hashstructure"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// 阻塞查询的最长等待时间
+const watchWaitTime = time.Minute
+
+type consulWatcher struct {
+	r  *consulRegistry
+	wo registry.WatchOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	next   chan *registry.Result
+
+	sync.Mutex
+	// 每个服务最近一次的结果, 按版本分组
+	services map[string][]*registry.Service
+	// 监听全部服务时, 每个服务对应的阻塞查询
+	watchers map[string]context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+func newConsulWatcher(cr *consulRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	parent := wo.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	cw := &consulWatcher{
+		r:        cr,
+		wo:       wo,
+		ctx:      ctx,
+		cancel:   cancel,
+		next:     make(chan *registry.Result, 10),
+		services: make(map[string][]*registry.Service),
+		watchers: make(map[string]context.CancelFunc),
+	}
+
+	if len(wo.Service) > 0 {
+		cw.wg.Add(1)
+		go cw.serviceHandler(ctx, wo.Service)
+	} else {
+		cw.wg.Add(1)
+		go cw.servicesHandler()
+	}
+
+	return cw, nil
+}
+
+// serviceHandler 对单个服务做阻塞查询, 每次索引变化时与上次的结果做比较
+func (cw *consulWatcher) serviceHandler(ctx context.Context, name string) {
+	defer cw.wg.Done()
+
+	var lastIndex uint64
+	errCnt := 0
+	for {
+		q := &consul.QueryOptions{
+			WaitIndex:  lastIndex,
+			WaitTime:   watchWaitTime,
+			AllowStale: true,
+		}
+
+		rsp, meta, err := cw.health(q.WithContext(ctx), name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("consul watch service:%s err:%v", name, err)
+			errCnt += 1
+			if !sleepCtx(ctx, watchBackoff(errCnt)) {
+				return
+			}
+			continue
+		}
+
+		errCnt = 0
+		if meta.LastIndex == lastIndex {
+			// 等待超时, 没有变化
+			continue
+		}
+		lastIndex = resetIndex(lastIndex, meta.LastIndex)
+
+		cw.update(ctx, name, buildServices(name, rsp, true))
+	}
+}
+
+// servicesHandler 对服务目录做阻塞查询, 为新出现的服务启动监听, 并移除已消失的服务
+func (cw *consulWatcher) servicesHandler() {
+	defer cw.wg.Done()
+
+	var lastIndex uint64
+	errCnt := 0
+	for {
+		q := &consul.QueryOptions{
+			WaitIndex:  lastIndex,
+			WaitTime:   watchWaitTime,
+			AllowStale: true,
+		}
+
+		client := cw.r.Client()
+		rsp, meta, err := client.Catalog().Services(q.WithContext(cw.ctx))
+		if err := cw.r.checkErr(client, err); err != nil {
+			if cw.ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("consul watch services err:%v", err)
+			errCnt += 1
+			if !sleepCtx(cw.ctx, watchBackoff(errCnt)) {
+				return
+			}
+			continue
+		}
+
+		errCnt = 0
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = resetIndex(lastIndex, meta.LastIndex)
+
+		var removed []*registry.Service
+
+		cw.Lock()
+		for name := range rsp {
+			if _, ok := cw.watchers[name]; ok {
+				continue
+			}
+
+			ctx, cancel := context.WithCancel(cw.ctx)
+			cw.watchers[name] = cancel
+			cw.wg.Add(1)
+			go cw.serviceHandler(ctx, name)
+		}
+
+		for name, cancel := range cw.watchers {
+			if _, ok := rsp[name]; ok {
+				continue
+			}
+
+			cancel()
+			delete(cw.watchers, name)
+			removed = append(removed, cw.services[name]...)
+			delete(cw.services, name)
+		}
+		cw.Unlock()
+
+		for _, s := range removed {
+			cw.emit(&registry.Result{Action: registry.Delete.String(), Service: s})
+		}
+	}
+}
+
+func (cw *consulWatcher) health(q *consul.QueryOptions, name string) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	client := cw.r.Client()
+	rsp, meta, err := client.Health().Service(name, "", false, q)
+	return rsp, meta, cw.r.checkErr(client, err)
+}
+
+// update 比较某个服务新旧两次的结果, 按版本发出 create/update/delete 事件.
+// update 事件中的 Service 是该版本当前完整的节点列表.
+func (cw *consulWatcher) update(ctx context.Context, name string, services []*registry.Service) {
+	cw.Lock()
+	if ctx.Err() != nil {
+		// 该服务的监听已被停止, 删除事件已经发出过了
+		cw.Unlock()
+		return
+	}
+
+	old := cw.services[name]
+	if len(services) > 0 {
+		cw.services[name] = services
+	} else {
+		delete(cw.services, name)
+	}
+	cw.Unlock()
+
+	oldMap := make(map[string]*registry.Service, len(old))
+	for _, s := range old {
+		oldMap[s.Version] = s
+	}
+
+	var results []*registry.Result
+	for _, s := range services {
+		o, ok := oldMap[s.Version]
+		delete(oldMap, s.Version)
+
+		if !ok {
+			results = append(results, &registry.Result{Action: registry.Create.String(), Service: s})
+			continue
+		}
+
+		if !serviceEqual(o, s) {
+			results = append(results, &registry.Result{Action: registry.Update.String(), Service: s})
+		}
+	}
+
+	for _, s := range oldMap {
+		results = append(results, &registry.Result{Action: registry.Delete.String(), Service: s})
+	}
+
+	for _, r := range results {
+		cw.emit(r)
+	}
+}
+
+func (cw *consulWatcher) emit(r *registry.Result) {
+	select {
+	case cw.next <- r:
+	case <-cw.ctx.Done():
+	}
+}
+
+func (cw *consulWatcher) Next() (*registry.Result, error) {
+	select {
+	case <-cw.ctx.Done():
+		return nil, registry.ErrWatcherStopped
+	case r := <-cw.next:
+		return r, nil
+	}
+}
+
+func (cw *consulWatcher) Stop() {
+	cw.cancel()
+	cw.wg.Wait()
+}
+
+func serviceEqual(a, b *registry.Service) bool {
+	ha, err := hash.Hash(a, nil)
+	if err != nil {
+		return false
+	}
+
+	hb, err := hash.Hash(b, nil)
+	if err != nil {
+		return false
+	}
+
+	return ha == hb
+}
+
+// resetIndex 按 consul 的建议, 索引回退时从 0 重新开始
+func resetIndex(lastIndex, index uint64) uint64 {
+	if index < lastIndex {
+		return 0
+	}
+	return index
+}
+
+func watchBackoff(errCnt int) time.Duration {
+	if errCnt >= 5 {
+		return time.Minute
+	}
+	return time.Duration(3*errCnt) * time.Second
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,451 @@
+// Package etcd provides an etcd v3 service registry
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	hash "github.com/mitchellh/hashstructure"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+var (
+	defaultPrefix  = "/base4go/registry/"
+	defaultTimeout = 5 * time.Second
+)
+
+type etcdRegistry struct {
+	opts   registry.Options
+	prefix string
+
+	// 开启认证时创建客户端需要连上 etcd, 失败后在下次调用时重试
+	mu     sync.Mutex
+	config clientv3.Config
+	client *clientv3.Client
+
+	sync.RWMutex
+	// node id -> hash of the registered service
+	register map[string]uint64
+	// node id -> lease id
+	leases map[string]clientv3.LeaseID
+}
+
+func configure(e *etcdRegistry, opts ...registry.Option) error {
+	for _, o := range opts {
+		o(&e.opts)
+	}
+
+	if e.opts.Timeout == 0 {
+		e.opts.Timeout = defaultTimeout
+	}
+
+	config := clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:2379"},
+		DialTimeout: e.opts.Timeout,
+	}
+
+	e.prefix = defaultPrefix
+	if e.opts.Context != nil {
+		if u, ok := e.opts.Context.Value(authKey).(*authCreds); ok {
+			config.Username = u.Username
+			config.Password = u.Password
+		}
+
+		if p, ok := e.opts.Context.Value(prefixKey).(string); ok && p != "" {
+			e.prefix = strings.TrimSuffix(p, "/") + "/"
+		}
+	}
+
+	var cAddrs []string
+	for _, address := range e.opts.Addrs {
+		if len(address) == 0 {
+			continue
+		}
+
+		// check we have a port
+		addr, port, err := net.SplitHostPort(address)
+		if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
+			port = "2379"
+			addr = address
+			cAddrs = append(cAddrs, net.JoinHostPort(addr, port))
+		} else if err == nil {
+			cAddrs = append(cAddrs, net.JoinHostPort(addr, port))
+		}
+	}
+
+	// if we got addrs then we'll update
+	if len(cAddrs) > 0 {
+		config.Endpoints = cAddrs
+	}
+
+	e.mu.Lock()
+	if e.client != nil {
+		e.client.Close()
+		e.client = nil
+	}
+	e.config = config
+	e.mu.Unlock()
+
+	_, err := e.getClient()
+	return err
+}
+
+// getClient 返回 etcd 客户端, 还没有创建成功时重新创建
+func (e *etcdRegistry) getClient() (*clientv3.Client, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.client != nil {
+		return e.client, nil
+	}
+
+	cli, err := clientv3.New(e.config)
+	if err != nil {
+		return nil, err
+	}
+	e.client = cli
+
+	return cli, nil
+}
+
+func encode(s *registry.Service) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func decode(ds []byte) *registry.Service {
+	var s *registry.Service
+	if err := json.Unmarshal(ds, &s); err != nil {
+		return nil
+	}
+	return s
+}
+
+func (e *etcdRegistry) nodePath(s, id string) string {
+	service := strings.Replace(s, "/", "-", -1)
+	node := strings.Replace(id, "/", "-", -1)
+	return path.Join(e.prefix, service, node)
+}
+
+func (e *etcdRegistry) servicePath(s string) string {
+	return path.Join(e.prefix, strings.Replace(s, "/", "-", -1)) + "/"
+}
+
+func (e *etcdRegistry) Init(opts ...registry.Option) error {
+	return configure(e, opts...)
+}
+
+func (e *etcdRegistry) Options() registry.Options {
+	return e.opts
+}
+
+func (e *etcdRegistry) registerNode(client *clientv3.Client, s *registry.Service, node *registry.Node, opts ...registry.RegisterOption) error {
+	// check existing lease cache
+	e.RLock()
+	leaseID, ok := e.leases[node.Id]
+	e.RUnlock()
+
+	if !ok {
+		// missing lease, check if the key exists
+		ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+		defer cancel()
+
+		// look for the existing key
+		rsp, err := client.Get(ctx, e.nodePath(s.Name, node.Id), clientv3.WithSerializable())
+		if err != nil {
+			return err
+		}
+
+		// get the existing lease
+		for _, kv := range rsp.Kvs {
+			if kv.Lease > 0 {
+				leaseID = clientv3.LeaseID(kv.Lease)
+
+				// decode the existing node
+				srv := decode(kv.Value)
+				if srv == nil || len(srv.Nodes) == 0 {
+					continue
+				}
+
+				// create hash of the registered service; uint64
+				h, err := hash.Hash(srv, nil)
+				if err != nil {
+					continue
+				}
+
+				// save the info
+				e.Lock()
+				e.leases[node.Id] = leaseID
+				e.register[node.Id] = h
+				e.Unlock()
+
+				break
+			}
+		}
+	}
+
+	var leaseNotFound bool
+
+	// renew the lease if it exists
+	if leaseID > 0 {
+		if _, err := client.KeepAliveOnce(context.TODO(), leaseID); err != nil {
+			if err != rpctypes.ErrLeaseNotFound {
+				return err
+			}
+
+			// lease not found do register
+			leaseNotFound = true
+		}
+	}
+
+	// the service as seen by this node, a new version, metadata or endpoints
+	// of the same node id must be written again
+	service := &registry.Service{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  s.Metadata,
+		Endpoints: s.Endpoints,
+		Nodes:     []*registry.Node{node},
+	}
+
+	// create hash of service; uint64
+	h, err := hash.Hash(service, nil)
+	if err != nil {
+		return err
+	}
+
+	// get existing hash for the service node
+	e.Lock()
+	v, ok := e.register[node.Id]
+	e.Unlock()
+
+	// the service is unchanged, skip registering
+	if ok && v == h && !leaseNotFound {
+		return nil
+	}
+
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+
+	var lgr *clientv3.LeaseGrantResponse
+	if options.TTL.Seconds() > 0 {
+		// get a lease used to expire keys since we have a ttl
+		lgr, err = client.Grant(ctx, int64(options.TTL.Seconds()))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("Registering %s id %s with lease %v and leaseID %v and ttl %v", service.Name, node.Id, lgr, leaseID, options.TTL)
+
+	// create an entry for the node
+	if lgr != nil {
+		_, err = client.Put(ctx, e.nodePath(service.Name, node.Id), encode(service), clientv3.WithLease(lgr.ID))
+	} else {
+		_, err = client.Put(ctx, e.nodePath(service.Name, node.Id), encode(service))
+	}
+	if err != nil {
+		return err
+	}
+
+	e.Lock()
+	// save our hash of the service
+	e.register[node.Id] = h
+	// save our leaseID of the service
+	if lgr != nil {
+		e.leases[node.Id] = lgr.ID
+	} else {
+		delete(e.leases, node.Id)
+	}
+	e.Unlock()
+
+	return nil
+}
+
+func (e *etcdRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	client, err := e.getClient()
+	if err != nil {
+		return err
+	}
+
+	var gerr error
+	for _, node := range s.Nodes {
+		e.Lock()
+		// delete our hash of the service
+		delete(e.register, node.Id)
+		// delete our lease of the service
+		delete(e.leases, node.Id)
+		e.Unlock()
+
+		log.Debugf("Deregistering %s id %s", s.Name, node.Id)
+		if err := e.deleteNode(client, s.Name, node.Id); err != nil {
+			gerr = err
+		}
+	}
+
+	return gerr
+}
+
+func (e *etcdRegistry) deleteNode(client *clientv3.Client, name, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+
+	_, err := client.Delete(ctx, e.nodePath(name, id))
+	return err
+}
+
+func (e *etcdRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	client, err := e.getClient()
+	if err != nil {
+		return err
+	}
+
+	var gerr error
+
+	// register each node individually
+	for _, node := range s.Nodes {
+		err := e.registerNode(client, s, node, opts...)
+		if err != nil {
+			gerr = err
+		}
+	}
+
+	return gerr
+}
+
+func (e *etcdRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+
+	rsp, err := client.Get(ctx, e.servicePath(name), clientv3.WithPrefix(), clientv3.WithSerializable())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rsp.Kvs) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	serviceMap := map[string]*registry.Service{}
+
+	for _, n := range rsp.Kvs {
+		if sn := decode(n.Value); sn != nil {
+			s, ok := serviceMap[sn.Version]
+			if !ok {
+				s = &registry.Service{
+					Name:      sn.Name,
+					Version:   sn.Version,
+					Metadata:  sn.Metadata,
+					Endpoints: sn.Endpoints,
+				}
+				serviceMap[s.Version] = s
+			}
+
+			s.Nodes = append(s.Nodes, sn.Nodes...)
+		}
+	}
+
+	services := make([]*registry.Service, 0, len(serviceMap))
+	for _, service := range serviceMap {
+		sort.Slice(service.Nodes, func(i, j int) bool {
+			return service.Nodes[i].Id < service.Nodes[j].Id
+		})
+		services = append(services, service)
+	}
+
+	return services, nil
+}
+
+func (e *etcdRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]*registry.Service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+
+	rsp, err := client.Get(ctx, e.prefix, clientv3.WithPrefix(), clientv3.WithSerializable())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rsp.Kvs) == 0 {
+		return []*registry.Service{}, nil
+	}
+
+	for _, n := range rsp.Kvs {
+		sn := decode(n.Value)
+		if sn == nil {
+			continue
+		}
+		v, ok := versions[sn.Name+sn.Version]
+		if !ok {
+			versions[sn.Name+sn.Version] = sn
+			continue
+		}
+		// append to service:version nodes
+		v.Nodes = append(v.Nodes, sn.Nodes...)
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, service := range versions {
+		services = append(services, service)
+	}
+
+	// sort the services
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+func (e *etcdRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newEtcdWatcher(e, opts...)
+}
+
+func (e *etcdRegistry) String() string {
+	return "etcd"
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	e := &etcdRegistry{
+		opts:     registry.Options{},
+		register: make(map[string]uint64),
+		leases:   make(map[string]clientv3.LeaseID),
+	}
+	if err := configure(e, opts...); err != nil {
+		log.Errorf("etcd registry configure err: %v, retry on the next call", err)
+	}
+	return e
+}
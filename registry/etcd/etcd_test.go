@@ -0,0 +1,152 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/internal/testutil/etcdtest"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/registrytest"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func testNode(version, id string) *registry.Service {
+	return &registry.Service{
+		Name:    "Greeter",
+		Version: version,
+		Nodes:   []*registry.Node{{Id: id, Address: id + ":8080"}},
+	}
+}
+
+func TestWatcherState(t *testing.T) {
+	ew := &etcdWatcher{services: make(map[string]map[string]*registry.Service)}
+
+	ew.putNode(testNode("v1", "a"))
+	ew.putNode(testNode("v1", "b"))
+	ew.putNode(testNode("v1", "b"))
+	ew.removeNode(testNode("v1", "a"))
+	ew.removeNode(testNode("v1", "b"))
+
+	expected := []struct {
+		action string
+		nodes  int
+	}{
+		{"create", 1},
+		{"update", 2},
+		{"update", 2},
+		{"update", 1},
+		{"delete", 1},
+	}
+
+	if len(ew.pending) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(ew.pending))
+	}
+	for i, e := range expected {
+		r := ew.pending[i]
+		if r.Action != e.action || len(r.Service.Nodes) != e.nodes {
+			t.Errorf("result %d: expected %s with %d nodes, got %s with %d nodes",
+				i, e.action, e.nodes, r.Action, len(r.Service.Nodes))
+		}
+	}
+
+	if len(ew.services) != 0 {
+		t.Errorf("expected empty state, got %v", ew.services)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	srv := etcdtest.NewServer(t)
+	r := NewRegistry(registry.Addrs(srv.Addr()), Prefix("/base4go/test/"))
+
+	w, err := r.Watch(registry.WatchService("Greeter"))
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	defer w.Stop()
+
+	s := testNode("v1", "a")
+	s.Nodes[0].Metadata = map[string]string{"gray": "true"}
+	if err := r.Register(s, registry.RegisterTTL(time.Second*5)); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 1 || services[0].Nodes[0].Metadata["gray"] != "true" {
+		t.Errorf("unexpected services: %+v", services)
+	}
+
+	if res, err := w.Next(); err != nil || res.Action != "create" {
+		t.Errorf("expected create, got %v %v", res, err)
+	}
+
+	if err := r.Deregister(s); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+
+	if res, err := w.Next(); err != nil || res.Action != "delete" {
+		t.Errorf("expected delete, got %v %v", res, err)
+	}
+}
+
+func TestReRegister(t *testing.T) {
+	srv := etcdtest.NewServer(t)
+	r := NewRegistry(registry.Addrs(srv.Addr()), Prefix("/base4go/test/"))
+
+	s := testNode("v1", "a")
+	if err := r.Register(s); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	// 同一个节点换了版本, 元数据和接口, 需要重新写入
+	s = testNode("v2", "a")
+	s.Metadata = map[string]string{"owner": "base4go"}
+	s.Endpoints = []*registry.Endpoint{{Name: "Greeter.SayHello"}}
+	if err := r.Register(s); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 1 || services[0].Version != "v2" || services[0].Metadata["owner"] != "base4go" || len(services[0].Endpoints) != 1 {
+		t.Errorf("expected re-registered service, got %+v", services[0])
+	}
+}
+
+func TestClientError(t *testing.T) {
+	// 开启认证时创建客户端需要连上 etcd
+	r := NewRegistry(registry.Addrs("127.0.0.1:1"), registry.Timeout(100*time.Millisecond), Auth("root", "root"))
+
+	if _, err := r.GetService("Greeter"); err == nil {
+		t.Error("get service: expected error")
+	}
+	if _, err := r.ListServices(); err == nil {
+		t.Error("list services: expected error")
+	}
+	if err := r.Register(testNode("v1", "a")); err == nil {
+		t.Error("register: expected error")
+	}
+	if err := r.Deregister(testNode("v1", "a")); err == nil {
+		t.Error("deregister: expected error")
+	}
+	if _, err := r.Watch(); err == nil {
+		t.Error("watch: expected error")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	srv := etcdtest.NewServer(t)
+
+	registrytest.RunConformance(t, func() registry.Registry {
+		return NewRegistry(registry.Addrs(srv.Addr()), Prefix("/base4go/test/"))
+	})
+}
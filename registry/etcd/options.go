@@ -0,0 +1,39 @@
+package etcd
+
+import (
+	"context"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// Define a custom type for context keys to avoid collisions.
+type contextKey string
+
+const authKey contextKey = "etcd_auth"
+const prefixKey contextKey = "etcd_prefix"
+
+type authCreds struct {
+	Username string
+	Password string
+}
+
+// Auth allows you to specify username/password.
+func Auth(username, password string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, authKey, &authCreds{Username: username, Password: password})
+	}
+}
+
+// Prefix is the key prefix under which services are stored,
+// defaults to /base4go/registry/.
+func Prefix(prefix string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, prefixKey, prefix)
+	}
+}
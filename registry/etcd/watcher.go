@@ -0,0 +1,209 @@
+package etcd
+
+import (
+	"context"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// etcdWatcher 在内存中维护被监听服务的各版本节点, 把 etcd 中节点级别的变化
+// 转换为版本级别的 create/update/delete 事件, 与 consul 的 watcher 保持一致.
+type etcdWatcher struct {
+	e  *etcdRegistry
+	wo registry.WatchOptions
+	w  clientv3.WatchChan
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// name -> version -> service
+	services map[string]map[string]*registry.Service
+	pending  []*registry.Result
+}
+
+func newEtcdWatcher(e *etcdRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	parent := wo.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+
+	watchPath := e.prefix
+	if len(wo.Service) > 0 {
+		watchPath = e.servicePath(wo.Service)
+	}
+
+	// 先取一份快照, 之后从快照的 revision 开始监听, 保证不丢事件
+	gctx, gcancel := context.WithTimeout(ctx, e.opts.Timeout)
+	rsp, err := client.Get(gctx, watchPath, clientv3.WithPrefix())
+	gcancel()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ew := &etcdWatcher{
+		e:        e,
+		wo:       wo,
+		ctx:      ctx,
+		cancel:   cancel,
+		services: make(map[string]map[string]*registry.Service),
+	}
+
+	for _, kv := range rsp.Kvs {
+		if sn := decode(kv.Value); sn != nil && len(sn.Nodes) > 0 {
+			ew.putNode(sn)
+		}
+	}
+	// 快照只用于建立状态, 不作为事件发出
+	ew.pending = nil
+
+	ew.w = client.Watch(ctx, watchPath,
+		clientv3.WithPrefix(),
+		clientv3.WithPrevKV(),
+		clientv3.WithRev(rsp.Header.Revision+1),
+	)
+
+	return ew, nil
+}
+
+func (ew *etcdWatcher) Next() (*registry.Result, error) {
+	for {
+		if len(ew.pending) > 0 {
+			r := ew.pending[0]
+			ew.pending = ew.pending[1:]
+			return r, nil
+		}
+
+		var wresp clientv3.WatchResponse
+		var ok bool
+		select {
+		case <-ew.ctx.Done():
+			return nil, registry.ErrWatcherStopped
+		case wresp, ok = <-ew.w:
+		}
+
+		if !ok || wresp.Canceled {
+			if err := wresp.Err(); err != nil && ew.ctx.Err() == nil {
+				return nil, err
+			}
+			return nil, registry.ErrWatcherStopped
+		}
+
+		if err := wresp.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, ev := range wresp.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				sn := decode(ev.Kv.Value)
+				if sn == nil || len(sn.Nodes) == 0 {
+					continue
+				}
+
+				// 节点的版本发生变化时, 先从旧版本中移除
+				if ev.PrevKv != nil {
+					if prev := decode(ev.PrevKv.Value); prev != nil && len(prev.Nodes) > 0 && prev.Version != sn.Version {
+						ew.removeNode(prev)
+					}
+				}
+				ew.putNode(sn)
+			case clientv3.EventTypeDelete:
+				if ev.PrevKv == nil {
+					continue
+				}
+
+				if prev := decode(ev.PrevKv.Value); prev != nil && len(prev.Nodes) > 0 {
+					ew.removeNode(prev)
+				}
+			}
+		}
+	}
+}
+
+// putNode 把 sn 的唯一节点加入对应版本, 并记录 create 或 update 事件
+func (ew *etcdWatcher) putNode(sn *registry.Service) {
+	versions, ok := ew.services[sn.Name]
+	if !ok {
+		versions = make(map[string]*registry.Service)
+		ew.services[sn.Name] = versions
+	}
+
+	node := sn.Nodes[0]
+	svc, ok := versions[sn.Version]
+	if !ok {
+		versions[sn.Version] = sn
+		ew.pending = append(ew.pending, &registry.Result{Action: registry.Create.String(), Service: copyService(sn)})
+		return
+	}
+
+	nodes := make([]*registry.Node, 0, len(svc.Nodes)+1)
+	for _, n := range svc.Nodes {
+		if n.Id != node.Id {
+			nodes = append(nodes, n)
+		}
+	}
+	svc.Nodes = append(nodes, node)
+	svc.Metadata = sn.Metadata
+	svc.Endpoints = sn.Endpoints
+
+	ew.pending = append(ew.pending, &registry.Result{Action: registry.Update.String(), Service: copyService(svc)})
+}
+
+// removeNode 从对应版本中删除 sn 的唯一节点, 版本没有节点时记录 delete 事件
+func (ew *etcdWatcher) removeNode(sn *registry.Service) {
+	versions, ok := ew.services[sn.Name]
+	if !ok {
+		return
+	}
+
+	svc, ok := versions[sn.Version]
+	if !ok {
+		return
+	}
+
+	node := sn.Nodes[0]
+	nodes := make([]*registry.Node, 0, len(svc.Nodes))
+	for _, n := range svc.Nodes {
+		if n.Id != node.Id {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if len(nodes) > 0 {
+		svc.Nodes = nodes
+		ew.pending = append(ew.pending, &registry.Result{Action: registry.Update.String(), Service: copyService(svc)})
+		return
+	}
+
+	delete(versions, sn.Version)
+	if len(versions) == 0 {
+		delete(ew.services, sn.Name)
+	}
+	ew.pending = append(ew.pending, &registry.Result{Action: registry.Delete.String(), Service: copyService(svc)})
+}
+
+func (ew *etcdWatcher) Stop() {
+	ew.cancel()
+}
+
+func copyService(s *registry.Service) *registry.Service {
+	cp := *s
+	cp.Nodes = make([]*registry.Node, len(s.Nodes))
+	copy(cp.Nodes, s.Nodes)
+	return &cp
+}
@@ -0,0 +1,543 @@
+// Package file provides a static registry read from a yaml or json file,
+// which is reloaded when the file changes.
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	hash "github.com/mitchellh/hashstructure"
+	"gopkg.in/yaml.v3"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+var (
+	defaultPath = "registry.yaml"
+
+	// 文件变化后等待一小段时间再加载, 合并编辑器的多次写入
+	reloadDelay = 100 * time.Millisecond
+)
+
+// fileData is the layout of the registry file.
+//
+//	services:
+//	  - name: Greeter
+//	    version: v1.0.0
+//	    metadata:
+//	      owner: base4go
+//	    nodes:
+//	      - id: Greeter-1
+//	        address: 127.0.0.1:9000
+//	        metadata:
+//	          gray: "true"
+type fileData struct {
+	Services []*registry.Service `json:"services" yaml:"services"`
+}
+
+type fileRegistry struct {
+	opts      registry.Options
+	path      string
+	writeBack bool
+
+	sync.RWMutex
+	// name -> version -> service
+	services map[string]map[string]*registry.Service
+	watchers map[*fileWatcher]struct{}
+
+	fw *fsnotify.Watcher
+}
+
+func configure(f *fileRegistry, opts ...registry.Option) error {
+	for _, o := range opts {
+		o(&f.opts)
+	}
+
+	f.path = defaultPath
+	if f.opts.Context != nil {
+		if p, ok := f.opts.Context.Value(pathKey).(string); ok && p != "" {
+			f.path = p
+		}
+
+		if v, ok := f.opts.Context.Value(writeBackKey).(bool); ok {
+			f.writeBack = v
+		}
+	}
+
+	// 先监听, 文件还不存在时也能在创建后加载
+	if err := f.watchFile(); err != nil {
+		return err
+	}
+
+	return f.load()
+}
+
+func (f *fileRegistry) Init(opts ...registry.Option) error {
+	return configure(f, opts...)
+}
+
+func (f *fileRegistry) Options() registry.Options {
+	return f.opts
+}
+
+// Register 默认不做任何事; 开启 WriteBack 时把节点合并后写回文件.
+func (f *fileRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	if !f.writeBack {
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	services := copyServices(f.services)
+	versions, ok := services[s.Name]
+	if !ok {
+		versions = make(map[string]*registry.Service)
+		services[s.Name] = versions
+	}
+
+	svc, ok := versions[s.Version]
+	if !ok {
+		svc = &registry.Service{
+			Name:    s.Name,
+			Version: s.Version,
+		}
+		versions[s.Version] = svc
+	}
+	// 保存副本, 调用方之后修改传入的服务不影响注册中心
+	svc.Metadata = copyMetadata(s.Metadata)
+	svc.Endpoints = copyEndpoints(s.Endpoints)
+
+	for _, node := range s.Nodes {
+		svc.Nodes = append(removeNode(svc.Nodes, node.Id), copyNode(node))
+	}
+
+	return f.save(services)
+}
+
+// Deregister 默认不做任何事; 开启 WriteBack 时从文件中删除节点.
+func (f *fileRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	if !f.writeBack {
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	services := copyServices(f.services)
+	svc, ok := services[s.Name][s.Version]
+	if !ok {
+		return nil
+	}
+
+	for _, node := range s.Nodes {
+		svc.Nodes = removeNode(svc.Nodes, node.Id)
+	}
+
+	if len(svc.Nodes) == 0 {
+		delete(services[s.Name], s.Version)
+		if len(services[s.Name]) == 0 {
+			delete(services, s.Name)
+		}
+	}
+
+	return f.save(services)
+}
+
+func (f *fileRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	versions, ok := f.services[name]
+	if !ok || len(versions) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, s := range versions {
+		services = append(services, copyService(s))
+	}
+
+	return services, nil
+}
+
+func (f *fileRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	var services []*registry.Service
+	for _, versions := range f.services {
+		for _, s := range versions {
+			services = append(services, copyService(s))
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+func (f *fileRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	w := &fileWatcher{
+		wo:   wo,
+		res:  make(chan *registry.Result, 128),
+		exit: make(chan bool),
+	}
+
+	f.Lock()
+	f.watchers[w] = struct{}{}
+	f.Unlock()
+
+	go func() {
+		var ctxDone <-chan struct{}
+		if wo.Context != nil {
+			ctxDone = wo.Context.Done()
+		}
+
+		select {
+		case <-w.exit:
+		case <-ctxDone:
+			w.Stop()
+		}
+
+		f.Lock()
+		delete(f.watchers, w)
+		f.Unlock()
+	}()
+
+	return w, nil
+}
+
+func (f *fileRegistry) String() string {
+	return "file"
+}
+
+// load 读取并解析文件, 成功后替换当前的服务列表并通知 watcher.
+// 解析失败时保留上一次的结果.
+func (f *fileRegistry) load() error {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var data fileData
+	if isJSON(f.path) {
+		err = json.Unmarshal(b, &data)
+	} else {
+		err = yaml.Unmarshal(b, &data)
+	}
+	if err != nil {
+		return err
+	}
+
+	services := make(map[string]map[string]*registry.Service)
+	for _, s := range data.Services {
+		if s == nil || len(s.Name) == 0 {
+			continue
+		}
+
+		versions, ok := services[s.Name]
+		if !ok {
+			versions = make(map[string]*registry.Service)
+			services[s.Name] = versions
+		}
+
+		// 同名同版本的条目合并节点
+		if svc, ok := versions[s.Version]; ok {
+			svc.Nodes = append(svc.Nodes, s.Nodes...)
+			continue
+		}
+		versions[s.Version] = s
+	}
+
+	f.Lock()
+	old := f.services
+	f.services = services
+	f.notify(old, services)
+	f.Unlock()
+
+	return nil
+}
+
+// save 把服务列表写回文件, 先写临时文件再重命名. 调用方需持有锁.
+func (f *fileRegistry) save(services map[string]map[string]*registry.Service) error {
+	var data fileData
+	for _, versions := range services {
+		for _, s := range versions {
+			data.Services = append(data.Services, s)
+		}
+	}
+
+	sort.Slice(data.Services, func(i, j int) bool {
+		if data.Services[i].Name == data.Services[j].Name {
+			return data.Services[i].Version < data.Services[j].Version
+		}
+		return data.Services[i].Name < data.Services[j].Name
+	})
+
+	var b []byte
+	var err error
+	if isJSON(f.path) {
+		b, err = json.MarshalIndent(&data, "", "  ")
+	} else {
+		b, err = yaml.Marshal(&data)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+
+	f.notify(f.services, services)
+	f.services = services
+	return nil
+}
+
+// watchFile 监听文件所在目录, 以兼容编辑器先写临时文件再重命名的保存方式
+func (f *fileRegistry) watchFile() error {
+	f.closeWatch()
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := fw.Add(filepath.Dir(f.path)); err != nil {
+		fw.Close()
+		return err
+	}
+
+	f.Lock()
+	f.fw = fw
+	f.Unlock()
+
+	go func() {
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		target := filepath.Clean(f.path)
+
+		for {
+			select {
+			case ev, ok := <-fw.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(ev.Name) != target {
+					continue
+				}
+				if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Rename) {
+					continue
+				}
+
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDelay, func() {
+					if err := f.load(); err != nil {
+						log.Errorf("file registry reload %s err: %v", f.path, err)
+						return
+					}
+					log.Infof("file registry reloaded. path:%s", f.path)
+				})
+			case err, ok := <-fw.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("file registry watch %s err: %v", f.path, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// notify 按版本比较新旧服务列表, 通知 watcher. 调用方需持有锁.
+func (f *fileRegistry) notify(old, cur map[string]map[string]*registry.Service) {
+	if len(f.watchers) == 0 {
+		return
+	}
+
+	var results []*registry.Result
+	for name, versions := range cur {
+		for version, s := range versions {
+			o, ok := old[name][version]
+			if !ok {
+				results = append(results, &registry.Result{Action: registry.Create.String(), Service: copyService(s)})
+			} else if !serviceEqual(o, s) {
+				results = append(results, &registry.Result{Action: registry.Update.String(), Service: copyService(s)})
+			}
+		}
+	}
+
+	for name, versions := range old {
+		for version, s := range versions {
+			if _, ok := cur[name][version]; !ok {
+				results = append(results, &registry.Result{Action: registry.Delete.String(), Service: copyService(s)})
+			}
+		}
+	}
+
+	for w := range f.watchers {
+		for _, r := range results {
+			if len(w.wo.Service) > 0 && w.wo.Service != r.Service.Name {
+				continue
+			}
+
+			select {
+			case <-w.exit:
+			case w.res <- r:
+			default:
+				// watcher 消费过慢时丢弃事件
+				log.Warnf("file registry watcher is full, drop %s event of %s %s", r.Action, r.Service.Name, r.Service.Version)
+			}
+		}
+	}
+}
+
+// closeWatch 停止监听文件, 监听的 goroutine 随之退出
+func (f *fileRegistry) closeWatch() {
+	f.Lock()
+	fw := f.fw
+	f.fw = nil
+	f.Unlock()
+
+	if fw != nil {
+		fw.Close()
+	}
+}
+
+// Close stops watching the file. The registry returned by NewRegistry
+// implements io.Closer.
+func (f *fileRegistry) Close() error {
+	f.closeWatch()
+	return nil
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	f := &fileRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+		},
+		services: make(map[string]map[string]*registry.Service),
+		watchers: make(map[*fileWatcher]struct{}),
+	}
+
+	if err := configure(f, opts...); errors.Is(err, os.ErrNotExist) {
+		log.Warnf("file registry %s doesn't exist, load it once created", f.path)
+	} else if err != nil {
+		log.Errorf("file registry configure err: %v", err)
+	}
+
+	return f
+}
+
+func isJSON(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+func serviceEqual(a, b *registry.Service) bool {
+	ha, err := hash.Hash(a, nil)
+	if err != nil {
+		return false
+	}
+
+	hb, err := hash.Hash(b, nil)
+	if err != nil {
+		return false
+	}
+
+	return ha == hb
+}
+
+func removeNode(nodes []*registry.Node, id string) []*registry.Node {
+	out := make([]*registry.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Id != id {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func copyService(s *registry.Service) *registry.Service {
+	cp := *s
+	cp.Nodes = make([]*registry.Node, len(s.Nodes))
+	copy(cp.Nodes, s.Nodes)
+	return &cp
+}
+
+func copyNode(n *registry.Node) *registry.Node {
+	return &registry.Node{
+		Id:       n.Id,
+		Address:  n.Address,
+		Metadata: copyMetadata(n.Metadata),
+	}
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(md))
+	for k, v := range md {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyEndpoints(eps []*registry.Endpoint) []*registry.Endpoint {
+	if eps == nil {
+		return nil
+	}
+	cp := make([]*registry.Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		e := *ep
+		e.Metadata = copyMetadata(ep.Metadata)
+		cp = append(cp, &e)
+	}
+	return cp
+}
+
+func copyServices(services map[string]map[string]*registry.Service) map[string]map[string]*registry.Service {
+	cp := make(map[string]map[string]*registry.Service, len(services))
+	for name, versions := range services {
+		cp[name] = make(map[string]*registry.Service, len(versions))
+		for version, s := range versions {
+			cp[name][version] = copyService(s)
+		}
+	}
+	return cp
+}
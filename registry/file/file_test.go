@@ -0,0 +1,190 @@
+package file
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/registrytest"
+)
+
+const testYaml = `
+services:
+  - name: Greeter
+    version: v1.0.0
+    metadata:
+      owner: base4go
+    nodes:
+      - id: Greeter-1
+        address: 127.0.0.1:9000
+        metadata:
+          gray: "true"
+`
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func TestLoadAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.yaml")
+	if err := os.WriteFile(path, []byte(testYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry(Path(path))
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 1 || services[0].Version != "v1.0.0" || services[0].Metadata["owner"] != "base4go" {
+		t.Fatalf("unexpected services: %+v", services)
+	}
+	if n := services[0].Nodes[0]; n.Address != "127.0.0.1:9000" || n.Metadata["gray"] != "true" {
+		t.Errorf("unexpected node: %+v", n)
+	}
+
+	w, err := r.Watch(registry.WatchService("Greeter"))
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	defer w.Stop()
+
+	if err := os.WriteFile(path, []byte(testYaml+`      - id: Greeter-2
+        address: 127.0.0.1:9001
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatalf("next err: %v", err)
+	}
+	if res.Action != "update" || len(res.Service.Nodes) != 2 {
+		t.Errorf("expected update with 2 nodes, got %s with %d nodes", res.Action, len(res.Service.Nodes))
+	}
+
+	// 文件解析失败时保留上一次的结果
+	if err := os.WriteFile(path, []byte("services: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(reloadDelay * 3)
+
+	services, err = r.GetService("Greeter")
+	if err != nil || len(services[0].Nodes) != 2 {
+		t.Errorf("expected last good services to be kept, got %+v %v", services, err)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte(`{"services": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &registry.Service{
+		Name:    "Greeter",
+		Version: "v1.0.0",
+		Nodes:   []*registry.Node{{Id: "Greeter-1", Address: "127.0.0.1:9000"}},
+	}
+
+	// 默认不写回
+	r := NewRegistry(Path(path))
+	if err := r.Register(s); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+	if _, err := r.GetService("Greeter"); err != registry.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	r = NewRegistry(Path(path), WriteBack(true))
+	if err := r.Register(s); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	// 保存的是副本
+	s.Nodes[0].Address = "127.0.0.1:9999"
+	if services, _ := r.GetService("Greeter"); len(services) != 1 || services[0].Nodes[0].Address != "127.0.0.1:9000" {
+		t.Errorf("registered node changed with the caller's: %+v", services)
+	}
+	s.Nodes[0].Address = "127.0.0.1:9000"
+
+	// 重新读取文件, 确认已写回
+	r2 := NewRegistry(Path(path))
+	services, err := r2.GetService("Greeter")
+	if err != nil || len(services) != 1 || services[0].Nodes[0].Id != "Greeter-1" {
+		t.Fatalf("unexpected services: %+v %v", services, err)
+	}
+
+	if err := r.Deregister(s); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+	if _, err := NewRegistry(Path(path)).GetService("Greeter"); err != registry.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// waitService 等待文件被重新加载后服务出现
+func waitService(t *testing.T, r registry.Registry, name string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := r.GetService(name); err == nil {
+			return
+		}
+		time.Sleep(reloadDelay / 2)
+	}
+	t.Fatalf("service %s was not loaded", name)
+}
+
+func TestMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.yaml")
+
+	r := NewRegistry(Path(path))
+	defer r.(io.Closer).Close()
+
+	if _, err := r.GetService("Greeter"); err != registry.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// 启动后才创建的文件也会被加载
+	if err := os.WriteFile(path, []byte(testYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitService(t, r, "Greeter")
+}
+
+func TestClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.yaml")
+	if err := os.WriteFile(path, []byte("services: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry(Path(path))
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatalf("close err: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(testYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(reloadDelay * 3)
+	if _, err := r.GetService("Greeter"); err != registry.ErrNotFound {
+		t.Errorf("reloaded after close: %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func() registry.Registry {
+		path := filepath.Join(t.TempDir(), "registry.yaml")
+		if err := os.WriteFile(path, []byte("services: []\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return NewRegistry(Path(path), WriteBack(true))
+	}, registrytest.SkipTTL())
+}
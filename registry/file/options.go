@@ -0,0 +1,35 @@
+package file
+
+import (
+	"context"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// Define a custom type for context keys to avoid collisions.
+type contextKey string
+
+const pathKey contextKey = "file_path"
+const writeBackKey contextKey = "file_write_back"
+
+// Path is the yaml or json file the services are read from,
+// defaults to registry.yaml. Files ending in .json are parsed as json.
+func Path(path string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pathKey, path)
+	}
+}
+
+// WriteBack makes Register and Deregister write the nodes back to the file.
+// By default both are no-ops.
+func WriteBack(b bool) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, writeBackKey, b)
+	}
+}
@@ -0,0 +1,30 @@
+package file
+
+import (
+	"sync"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+type fileWatcher struct {
+	wo   registry.WatchOptions
+	res  chan *registry.Result
+	exit chan bool
+	once sync.Once
+}
+
+func (w *fileWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-w.res:
+		return r, nil
+	case <-w.exit:
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+// Stop 可能同时被调用方和 Watch 中监听 Context 的 goroutine 调用
+func (w *fileWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.exit)
+	})
+}
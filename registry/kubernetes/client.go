@@ -0,0 +1,195 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+var errNoClient = errors.New("kubernetes: no api server, not in a cluster and no kubeconfig found")
+
+// newClient 按以下顺序创建 clientset, 并确定命名空间:
+// Client 选项, Config 选项, registry.Addrs, Kubeconfig 选项,
+// 最后与 kubectl 相同: $KUBECONFIG 或 ~/.kube/config, 再退回 pod 内的 service account.
+func newClient(opts registry.Options) (kubernetes.Interface, string, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	namespace, _ := ctx.Value(namespaceKey).(string)
+
+	if c, ok := ctx.Value(clientKey).(kubernetes.Interface); ok && c != nil {
+		if namespace == "" {
+			namespace = corev1.NamespaceDefault
+		}
+		return c, namespace, nil
+	}
+
+	config, _ := ctx.Value(restConfigKey).(*rest.Config)
+	if config == nil && len(opts.Addrs) > 0 {
+		config = addrsConfig(ctx, opts.Addrs[0])
+	}
+
+	if config == nil {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if path, ok := ctx.Value(kubeconfigKey).(string); ok && path != "" {
+			rules.ExplicitPath = path
+		}
+
+		cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+		c, err := cc.ClientConfig()
+		if clientcmd.IsEmptyConfig(err) {
+			return nil, "", errNoClient
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		config = c
+
+		// 在 pod 内时返回 service account 的命名空间
+		if namespace == "" {
+			namespace, _, _ = cc.Namespace()
+		}
+	}
+
+	if namespace == "" {
+		namespace = corev1.NamespaceDefault
+	}
+
+	// 不设置 config.Timeout, 否则 informer 的长连接 watch 会被它打断
+	c, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, namespace, nil
+}
+
+// addrsConfig 使用 registry.Addrs 中的地址, 以及 Token 和 TLSConfig 选项
+func addrsConfig(ctx context.Context, host string) *rest.Config {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+
+	config := &rest.Config{Host: host}
+	if v, ok := ctx.Value(tokenKey).(string); ok && v != "" {
+		config.BearerToken = v
+	}
+	if v, ok := ctx.Value(tlsConfigKey).(*tls.Config); ok && v != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = v
+		config.Transport = transport
+	}
+
+	return config
+}
+
+// informerCache 缓存命名空间内的 Service, EndpointSlice 和 Pod
+type informerCache struct {
+	factory  informers.SharedInformerFactory
+	stop     chan struct{}
+	informer []toolscache.SharedIndexInformer
+
+	services corelisters.ServiceLister
+	slices   discoverylisters.EndpointSliceLister
+	pods     corelisters.PodLister
+}
+
+// newInformerCache 启动 informer 并等待首次同步完成
+func newInformerCache(client kubernetes.Interface, namespace string, timeout time.Duration) (*informerCache, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTransform(trimObject),
+	)
+
+	c := &informerCache{
+		factory:  factory,
+		stop:     make(chan struct{}),
+		services: factory.Core().V1().Services().Lister(),
+		slices:   factory.Discovery().V1().EndpointSlices().Lister(),
+		pods:     factory.Core().V1().Pods().Lister(),
+	}
+	c.informer = []toolscache.SharedIndexInformer{
+		factory.Core().V1().Services().Informer(),
+		factory.Discovery().V1().EndpointSlices().Informer(),
+		factory.Core().V1().Pods().Informer(),
+	}
+	factory.Start(c.stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for t, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			c.close()
+			return nil, fmt.Errorf("kubernetes: timed out syncing %v in namespace %s", t, namespace)
+		}
+	}
+
+	return c, nil
+}
+
+// addHandler 在任何对象变化时调用 fn, 返回的函数用于移除
+func (c *informerCache) addHandler(fn func()) (func(), error) {
+	handler := toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { fn() },
+		UpdateFunc: func(interface{}, interface{}) { fn() },
+		DeleteFunc: func(interface{}) { fn() },
+	}
+
+	var regs []toolscache.ResourceEventHandlerRegistration
+	remove := func() {
+		for i, reg := range regs {
+			c.informer[i].RemoveEventHandler(reg)
+		}
+	}
+
+	for _, inf := range c.informer {
+		reg, err := inf.AddEventHandler(handler)
+		if err != nil {
+			remove()
+			return nil, err
+		}
+		regs = append(regs, reg)
+	}
+
+	return remove, nil
+}
+
+func (c *informerCache) close() {
+	close(c.stop)
+	c.factory.Shutdown()
+}
+
+// trimObject 只保留 Pod 的 metadata, 减少缓存占用的内存
+func trimObject(obj interface{}) (interface{}, error) {
+	if pod, ok := obj.(*corev1.Pod); ok {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            pod.Name,
+				Namespace:       pod.Namespace,
+				UID:             pod.UID,
+				ResourceVersion: pod.ResourceVersion,
+				Labels:          pod.Labels,
+				Annotations:     pod.Annotations,
+			},
+		}, nil
+	}
+	return obj, nil
+}
@@ -0,0 +1,415 @@
+// Package kubernetes provides a read-only registry backed by Kubernetes
+// Services and EndpointSlices, for clusters where consul isn't deployed.
+//
+// A Service is mapped to a registry.Service as follows:
+//
+//	metadata:
+//	  name: greeter
+//	  labels:
+//	    base4go.io/name: Greeter        # registry name, defaults to the Service name
+//	    base4go.io/version: v1.0.0      # version
+//	  annotations:
+//	    base4go.io/metadata-owner: base4go  # service metadata owner=base4go
+//	    base4go.io/port: grpc           # port name used for the nodes
+//
+// Every ready endpoint of the Service's EndpointSlices becomes a node. The
+// labels and annotations of its pod are copied into the node metadata, so a
+// pod labelled gray: "true" is routed as a gray node, together with the pod,
+// node, zone and hostname. Services of the same name and different versions
+// are returned as different versions.
+//
+// Services, EndpointSlices and Pods of the namespace are cached by client-go
+// informers, started on first use, and watchers are notified by them.
+package kubernetes
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+const (
+	labelName                = "base4go.io/name"
+	labelVersion             = "base4go.io/version"
+	annotationMetadataPrefix = "base4go.io/metadata-"
+	annotationPort           = "base4go.io/port"
+)
+
+// 等待 informer 首次同步的时间
+var defaultTimeout = 10 * time.Second
+
+type k8sRegistry struct {
+	opts      registry.Options
+	client    kubernetes.Interface
+	namespace string
+	// 创建 client 失败的原因
+	err error
+
+	mu    sync.Mutex
+	cache *informerCache
+}
+
+func configure(k *k8sRegistry, opts ...registry.Option) error {
+	for _, o := range opts {
+		o(&k.opts)
+	}
+
+	client, namespace, err := newClient(k.opts)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// 连接参数可能变了, 重新启动 informer
+	if k.cache != nil {
+		k.cache.close()
+		k.cache = nil
+	}
+
+	k.client = client
+	k.namespace = namespace
+	k.err = err
+
+	return err
+}
+
+// informers 返回命名空间的缓存, 第一次调用时启动 informer
+func (k *k8sRegistry) informers() (*informerCache, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.err != nil {
+		return nil, k.err
+	}
+
+	if k.cache == nil {
+		timeout := defaultTimeout
+		if k.opts.Timeout > 0 {
+			timeout = k.opts.Timeout
+		}
+
+		c, err := newInformerCache(k.client, k.namespace, timeout)
+		if err != nil {
+			return nil, err
+		}
+		k.cache = c
+	}
+
+	return k.cache, nil
+}
+
+func (k *k8sRegistry) Init(opts ...registry.Option) error {
+	return configure(k, opts...)
+}
+
+func (k *k8sRegistry) Options() registry.Options {
+	return k.opts
+}
+
+// Register 不做任何事, 节点由 kubernetes 根据 pod 的状态维护
+func (k *k8sRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	return nil
+}
+
+// Deregister 不做任何事, 节点由 kubernetes 根据 pod 的状态维护
+func (k *k8sRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	return nil
+}
+
+func (k *k8sRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	c, err := k.informers()
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := k.snapshot(c)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := services[name]
+	if len(versions) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	result := make([]*registry.Service, 0, len(versions))
+	for _, s := range versions {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+
+	return result, nil
+}
+
+func (k *k8sRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	c, err := k.informers()
+	if err != nil {
+		return nil, err
+	}
+
+	svcs, err := c.services.Services(k.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*registry.Service
+	for _, s := range svcs {
+		services = append(services, &registry.Service{
+			Name:     serviceName(s),
+			Version:  s.Labels[labelVersion],
+			Metadata: serviceMetadata(s),
+		})
+	}
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+func (k *k8sRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	c, err := k.informers()
+	if err != nil {
+		return nil, err
+	}
+	return newK8sWatcher(k, c, opts...)
+}
+
+func (k *k8sRegistry) String() string {
+	return "kubernetes"
+}
+
+// Close stops the informers. The registry returned by NewRegistry
+// implements io.Closer.
+func (k *k8sRegistry) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cache != nil {
+		k.cache.close()
+		k.cache = nil
+	}
+	return nil
+}
+
+// snapshot 从缓存构造命名空间下全部服务, name -> version -> service
+func (k *k8sRegistry) snapshot(c *informerCache) (map[string]map[string]*registry.Service, error) {
+	svcs, err := c.services.Services(k.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := c.slices.EndpointSlices(k.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := c.pods.Pods(k.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	slices := make(map[string][]*discoveryv1.EndpointSlice)
+	for _, es := range items {
+		svc := es.Labels[discoveryv1.LabelServiceName]
+		slices[svc] = append(slices[svc], es)
+	}
+
+	podMap := make(map[string]*corev1.Pod, len(pods))
+	for _, p := range pods {
+		podMap[p.Name] = p
+	}
+
+	return buildServices(svcs, slices, podMap), nil
+}
+
+// buildServices 把 Service 和它们的 EndpointSlice 转成 name -> version -> service,
+// 没有可用节点的版本会被忽略. slices 以 Service 的名字为 key, pods 以 Pod 的名字为 key.
+func buildServices(svcs []*corev1.Service, slices map[string][]*discoveryv1.EndpointSlice, pods map[string]*corev1.Pod) map[string]map[string]*registry.Service {
+	services := make(map[string]map[string]*registry.Service)
+
+	for _, s := range svcs {
+		nodes := buildNodes(s, slices[s.Name], pods)
+		if len(nodes) == 0 {
+			continue
+		}
+
+		name := serviceName(s)
+		version := s.Labels[labelVersion]
+
+		versions, ok := services[name]
+		if !ok {
+			versions = make(map[string]*registry.Service)
+			services[name] = versions
+		}
+
+		svc, ok := versions[version]
+		if !ok {
+			svc = &registry.Service{
+				Name:     name,
+				Version:  version,
+				Metadata: serviceMetadata(s),
+			}
+			versions[version] = svc
+		}
+		svc.Nodes = append(svc.Nodes, nodes...)
+	}
+
+	for _, versions := range services {
+		for _, svc := range versions {
+			sort.Slice(svc.Nodes, func(i, j int) bool { return svc.Nodes[i].Id < svc.Nodes[j].Id })
+		}
+	}
+
+	return services
+}
+
+// buildNodes 把 ready 的 endpoint 转成节点, 同一个 pod 只保留一个节点
+func buildNodes(s *corev1.Service, slices []*discoveryv1.EndpointSlice, pods map[string]*corev1.Pod) []*registry.Node {
+	portName := s.Annotations[annotationPort]
+
+	var nodes []*registry.Node
+	seen := make(map[string]bool)
+	for _, es := range slices {
+		if es.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+
+		port, ok := selectPort(es.Ports, portName)
+		if !ok {
+			continue
+		}
+
+		for _, ep := range es.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+
+			var pod *corev1.Pod
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				pod = pods[ep.TargetRef.Name]
+			}
+
+			for _, addr := range ep.Addresses {
+				address := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+
+				id := address
+				if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+					id = ep.TargetRef.Name
+				}
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+
+				nodes = append(nodes, &registry.Node{
+					Id:       id,
+					Address:  address,
+					Metadata: nodeMetadata(ep, pod),
+				})
+			}
+		}
+	}
+
+	return nodes
+}
+
+// selectPort 选择节点端口: 指定了名字时按名字, 否则优先 grpc, 再否则第一个
+func selectPort(ports []discoveryv1.EndpointPort, name string) (int32, bool) {
+	if name == "" {
+		name = "grpc"
+		if p, ok := selectPort(ports, name); ok {
+			return p, true
+		}
+
+		for _, p := range ports {
+			if p.Port != nil {
+				return *p.Port, true
+			}
+		}
+		return 0, false
+	}
+
+	for _, p := range ports {
+		if p.Name != nil && *p.Name == name && p.Port != nil {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+func serviceName(s *corev1.Service) string {
+	if name := s.Labels[labelName]; name != "" {
+		return name
+	}
+	return s.Name
+}
+
+func serviceMetadata(s *corev1.Service) map[string]string {
+	md := make(map[string]string)
+	for k, v := range s.Annotations {
+		if strings.HasPrefix(k, annotationMetadataPrefix) {
+			md[strings.TrimPrefix(k, annotationMetadataPrefix)] = v
+		}
+	}
+	return md
+}
+
+// nodeMetadata 返回 pod 的 labels 和 annotations, 以及 endpoint 的位置信息.
+// pod 为 nil 时(endpoint 不指向 pod, 或 pod 还没有同步到缓存)只有位置信息.
+func nodeMetadata(ep discoveryv1.Endpoint, pod *corev1.Pod) map[string]string {
+	md := make(map[string]string)
+	if pod != nil {
+		for k, v := range pod.Labels {
+			md[k] = v
+		}
+		for k, v := range pod.Annotations {
+			md[k] = v
+		}
+	}
+
+	if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+		md["pod"] = ep.TargetRef.Name
+	}
+	if ep.NodeName != nil && *ep.NodeName != "" {
+		md["node"] = *ep.NodeName
+	}
+	if ep.Zone != nil && *ep.Zone != "" {
+		md["zone"] = *ep.Zone
+	}
+	if ep.Hostname != nil && *ep.Hostname != "" {
+		md["hostname"] = *ep.Hostname
+	}
+	return md
+}
+
+// NewRegistry creates a kubernetes registry. Inside a cluster the api server,
+// namespace and credentials of the service account are used, outside it the
+// kubeconfig.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	k := &k8sRegistry{
+		opts: registry.Options{},
+	}
+
+	if err := configure(k, opts...); err != nil {
+		log.Errorf("kubernetes registry configure err: %v", err)
+	}
+
+	return k
+}
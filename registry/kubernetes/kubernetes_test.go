@@ -0,0 +1,264 @@
+package kubernetes
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func testService(name string, labels, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   "test",
+		Labels:      labels,
+		Annotations: annotations,
+	}}
+}
+
+func testPod(name string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", Labels: labels}}
+}
+
+func testSlice(svc, suffix string, ready bool, pods ...string) *discoveryv1.EndpointSlice {
+	es := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc + "-" + suffix,
+			Namespace: "test",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: svc},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: ptr("http"), Port: ptr(int32(8080))},
+			{Name: ptr("grpc"), Port: ptr(int32(9000))},
+		},
+	}
+	for i, pod := range pods {
+		es.Endpoints = append(es.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{"10.0.0." + string(rune('1'+i))},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr(ready)},
+			NodeName:   ptr("node-1"),
+			Zone:       ptr("zone-a"),
+			TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod},
+		})
+	}
+	return es
+}
+
+// newTestRegistry 返回使用 fake clientset 的注册中心, 等 informer 的 watch 都建立后才返回,
+// 否则 fake clientset 会丢掉 list 和 watch 之间的变化
+func newTestRegistry(t *testing.T, objs ...runtime.Object) (registry.Registry, *fake.Clientset) {
+	cs := fake.NewClientset(objs...)
+
+	watching := make(chan string, 3)
+	cs.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		select {
+		case watching <- action.GetResource().Resource:
+		default:
+		}
+		return false, nil, nil
+	})
+
+	r := NewRegistry(Client(cs), Namespace("test"))
+	t.Cleanup(func() { r.(io.Closer).Close() })
+
+	if _, err := r.ListServices(); err != nil {
+		t.Fatalf("list services err: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-watching:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the informers to watch")
+		}
+	}
+
+	return r, cs
+}
+
+func TestGetService(t *testing.T) {
+	r, _ := newTestRegistry(t,
+		testService("greeter-v1",
+			map[string]string{labelName: "Greeter", labelVersion: "v1.0.0"},
+			map[string]string{annotationMetadataPrefix + "owner": "base4go", "other": "x"}),
+		testService("greeter-v2", map[string]string{labelName: "Greeter", labelVersion: "v2.0.0"}, nil),
+		testService("redis", nil, nil),
+		testSlice("greeter-v1", "a", true, "greeter-v1-a", "greeter-v1-b"),
+		testSlice("greeter-v1", "b", false, "greeter-v1-c"),
+		testSlice("greeter-v2", "a", true, "greeter-v2-a"),
+		testPod("greeter-v1-a", map[string]string{"app": "greeter", "gray": "true"}),
+	)
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(services))
+	}
+
+	v1 := services[0]
+	if v1.Version != "v1.0.0" || v1.Metadata["owner"] != "base4go" || len(v1.Metadata) != 1 {
+		t.Errorf("unexpected service: %+v", v1)
+	}
+	if len(v1.Nodes) != 2 {
+		t.Fatalf("expected 2 ready nodes, got %d", len(v1.Nodes))
+	}
+	n := v1.Nodes[0]
+	if n.Id != "greeter-v1-a" || n.Address != "10.0.0.1:9000" {
+		t.Errorf("unexpected node: %+v", n)
+	}
+	if n.Metadata["pod"] != "greeter-v1-a" || n.Metadata["node"] != "node-1" || n.Metadata["zone"] != "zone-a" {
+		t.Errorf("unexpected node metadata: %v", n.Metadata)
+	}
+	if n.Metadata["gray"] != "true" || n.Metadata["app"] != "greeter" {
+		t.Errorf("pod labels not copied: %v", n.Metadata)
+	}
+	if _, ok := v1.Nodes[1].Metadata["gray"]; ok {
+		t.Errorf("unexpected gray label on %s: %v", v1.Nodes[1].Id, v1.Nodes[1].Metadata)
+	}
+
+	if _, err := r.GetService("redis"); err != registry.ErrNotFound {
+		t.Errorf("service without endpoints: expected ErrNotFound, got %v", err)
+	}
+
+	list, err := r.ListServices()
+	if err != nil {
+		t.Fatalf("list services err: %v", err)
+	}
+	if len(list) != 3 || list[0].Name != "Greeter" || list[2].Name != "redis" {
+		t.Errorf("unexpected list: %+v", list)
+	}
+}
+
+func TestSelectPort(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{
+		{Name: ptr("http"), Port: ptr(int32(8080))},
+		{Name: ptr("grpc"), Port: ptr(int32(9000))},
+	}
+
+	if p, _ := selectPort(ports, ""); p != 9000 {
+		t.Errorf("expected grpc port, got %d", p)
+	}
+	if p, _ := selectPort(ports, "http"); p != 8080 {
+		t.Errorf("expected named port, got %d", p)
+	}
+	if p, _ := selectPort(ports[:1], ""); p != 8080 {
+		t.Errorf("expected first port, got %d", p)
+	}
+	if _, ok := selectPort(ports, "metrics"); ok {
+		t.Error("unknown port name should not match")
+	}
+}
+
+func TestKubeconfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(path, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+    namespace: greeter
+current-context: test
+users:
+- name: test
+  user:
+    token: test-token
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opts registry.Options
+	Kubeconfig(path)(&opts)
+
+	_, namespace, err := newClient(opts)
+	if err != nil {
+		t.Fatalf("kubeconfig err: %v", err)
+	}
+	if namespace != "greeter" {
+		t.Errorf("expected namespace of the context, got %q", namespace)
+	}
+
+	// 不在集群内, 也没有 kubeconfig
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, _, err := newClient(registry.Options{}); err != errNoClient {
+		t.Errorf("expected errNoClient, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, cs := newTestRegistry(t, testService("greeter", map[string]string{labelName: "Greeter", labelVersion: "v1"}, nil))
+	slices := cs.DiscoveryV1().EndpointSlices("test")
+	ctx := context.Background()
+
+	w, err := r.Watch(registry.WatchService("Greeter"))
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	defer w.Stop()
+
+	steps := []struct {
+		change func() error
+		action string
+		nodes  int
+	}{
+		{func() error {
+			_, err := slices.Create(ctx, testSlice("greeter", "a", true, "a"), metav1.CreateOptions{})
+			return err
+		}, "create", 1},
+		{func() error {
+			_, err := slices.Update(ctx, testSlice("greeter", "a", true, "a", "b"), metav1.UpdateOptions{})
+			return err
+		}, "update", 2},
+		// pod 的 label 变化也是节点的变化
+		{func() error {
+			_, err := cs.CoreV1().Pods("test").Create(ctx, testPod("a", map[string]string{"gray": "true"}), metav1.CreateOptions{})
+			return err
+		}, "update", 2},
+		{func() error {
+			return slices.Delete(ctx, "greeter-a", metav1.DeleteOptions{})
+		}, "delete", 2},
+	}
+
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("change err: %v", err)
+		}
+
+		res, err := w.Next()
+		if err != nil {
+			t.Fatalf("next err: %v", err)
+		}
+		if res.Action != step.action || len(res.Service.Nodes) != step.nodes {
+			t.Errorf("expected %s with %d nodes, got %s with %d", step.action, step.nodes, res.Action, len(res.Service.Nodes))
+		}
+	}
+}
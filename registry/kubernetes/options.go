@@ -0,0 +1,65 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// Define a custom type for context keys to avoid collisions.
+type contextKey string
+
+const namespaceKey contextKey = "kubernetes_namespace"
+const tokenKey contextKey = "kubernetes_token"
+const tlsConfigKey contextKey = "kubernetes_tls_config"
+const kubeconfigKey contextKey = "kubernetes_kubeconfig"
+const restConfigKey contextKey = "kubernetes_rest_config"
+const clientKey contextKey = "kubernetes_client"
+
+func setRegistryOption(k, v interface{}) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+// Namespace is the namespace services are looked up in, defaults to
+// the namespace of the pod, or the namespace of the kubeconfig context.
+func Namespace(ns string) registry.Option {
+	return setRegistryOption(namespaceKey, ns)
+}
+
+// Token is the bearer token used to call the api server given by
+// registry.Addrs.
+func Token(token string) registry.Option {
+	return setRegistryOption(tokenKey, token)
+}
+
+// TLSConfig is used to connect to the api server given by registry.Addrs.
+func TLSConfig(t *tls.Config) registry.Option {
+	return setRegistryOption(tlsConfigKey, t)
+}
+
+// Kubeconfig is the path of the kubeconfig file to use. Without it, and
+// without registry.Addrs, the config is loaded like kubectl does: from
+// $KUBECONFIG or ~/.kube/config, falling back to the in-cluster config.
+func Kubeconfig(path string) registry.Option {
+	return setRegistryOption(kubeconfigKey, path)
+}
+
+// Config is the client-go config used to connect to the api server.
+func Config(c *rest.Config) registry.Option {
+	return setRegistryOption(restConfigKey, c)
+}
+
+// Client is the clientset used to talk to the api server, it takes
+// precedence over all the connection options.
+func Client(c kubernetes.Interface) registry.Option {
+	return setRegistryOption(clientKey, c)
+}
@@ -0,0 +1,167 @@
+package kubernetes
+
+import (
+	"context"
+
+	hash "github.com/mitchellh/hashstructure"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// k8sWatcher 在 informer 通知变化时从缓存重新构造服务, 按版本比较后产生事件
+type k8sWatcher struct {
+	k      *k8sRegistry
+	c      *informerCache
+	wo     registry.WatchOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+	res    chan *registry.Result
+	// 有变化时写入, 多次变化合并为一次
+	notify chan struct{}
+	remove func()
+
+	// name -> version -> service
+	services map[string]map[string]*registry.Service
+}
+
+func newK8sWatcher(k *k8sRegistry, c *informerCache, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	ctx := wo.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	w := &k8sWatcher{
+		k:      k,
+		c:      c,
+		wo:     wo,
+		ctx:    ctx,
+		cancel: cancel,
+		res:    make(chan *registry.Result, 128),
+		notify: make(chan struct{}, 1),
+	}
+
+	// 以当前状态为起点, 不产生初始事件
+	services, err := w.snapshot()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w.services = services
+
+	remove, err := c.addHandler(w.changed)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w.remove = remove
+
+	go w.run()
+	return w, nil
+}
+
+func (w *k8sWatcher) changed() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *k8sWatcher) snapshot() (map[string]map[string]*registry.Service, error) {
+	services, err := w.k.snapshot(w.c)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(w.wo.Service) > 0 {
+		services = map[string]map[string]*registry.Service{
+			w.wo.Service: services[w.wo.Service],
+		}
+	}
+	return services, nil
+}
+
+func (w *k8sWatcher) run() {
+	defer w.remove()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.notify:
+		}
+
+		services, err := w.snapshot()
+		if err != nil {
+			log.Errorf("kubernetes watcher err: %v", err)
+			continue
+		}
+
+		w.update(services)
+	}
+}
+
+// update 按版本比较新旧服务列表并发送事件
+func (w *k8sWatcher) update(cur map[string]map[string]*registry.Service) {
+	old := w.services
+	w.services = cur
+
+	var results []*registry.Result
+	for name, versions := range cur {
+		for version, s := range versions {
+			o, ok := old[name][version]
+			if !ok {
+				results = append(results, &registry.Result{Action: registry.Create.String(), Service: s})
+			} else if !serviceEqual(o, s) {
+				results = append(results, &registry.Result{Action: registry.Update.String(), Service: s})
+			}
+		}
+	}
+
+	for name, versions := range old {
+		for version, s := range versions {
+			if _, ok := cur[name][version]; !ok {
+				results = append(results, &registry.Result{Action: registry.Delete.String(), Service: s})
+			}
+		}
+	}
+
+	for _, r := range results {
+		select {
+		case <-w.ctx.Done():
+			return
+		case w.res <- r:
+		}
+	}
+}
+
+func serviceEqual(a, b *registry.Service) bool {
+	ha, err := hash.Hash(a, nil)
+	if err != nil {
+		return false
+	}
+	hb, err := hash.Hash(b, nil)
+	if err != nil {
+		return false
+	}
+	return ha == hb
+}
+
+func (w *k8sWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-w.res:
+		return r, nil
+	case <-w.ctx.Done():
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+func (w *k8sWatcher) Stop() {
+	w.cancel()
+}
@@ -0,0 +1,344 @@
+// Package memory provides an in-memory registry, used for tests and
+// single-process deployments.
+package memory
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+var (
+	// 检查过期节点的间隔
+	ttlPruneTime = time.Second
+)
+
+type node struct {
+	*registry.Node
+	TTL      time.Duration
+	LastSeen time.Time
+}
+
+type record struct {
+	Name      string
+	Version   string
+	Metadata  map[string]string
+	Nodes     map[string]*node
+	Endpoints []*registry.Endpoint
+}
+
+type memRegistry struct {
+	opts registry.Options
+
+	sync.RWMutex
+	// name -> version -> record
+	records  map[string]map[string]*record
+	watchers map[string]*memWatcher
+
+	// 关闭后停止检查过期节点
+	exit      chan struct{}
+	closeOnce sync.Once
+}
+
+func configure(m *memRegistry, opts ...registry.Option) {
+	for _, o := range opts {
+		o(&m.opts)
+	}
+
+	if m.opts.Context == nil {
+		return
+	}
+
+	services, ok := m.opts.Context.Value(servicesKey).(map[string][]*registry.Service)
+	if !ok || len(services) == 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for name, list := range services {
+		if _, ok := m.records[name]; !ok {
+			m.records[name] = make(map[string]*record)
+		}
+		for _, s := range list {
+			m.records[name][s.Version] = serviceToRecord(s, 0)
+		}
+	}
+}
+
+func (m *memRegistry) Init(opts ...registry.Option) error {
+	configure(m, opts...)
+	return nil
+}
+
+func (m *memRegistry) Options() registry.Options {
+	return m.opts
+}
+
+func (m *memRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	versions, ok := m.records[s.Name]
+	if !ok {
+		versions = make(map[string]*record)
+		m.records[s.Name] = versions
+	}
+
+	r, ok := versions[s.Version]
+	if !ok {
+		versions[s.Version] = serviceToRecord(s, options.TTL)
+		m.sendEvent(registry.Create, versions[s.Version])
+		return nil
+	}
+
+	changed := false
+	for _, n := range s.Nodes {
+		if old, ok := r.Nodes[n.Id]; ok {
+			// 已存在的节点只刷新心跳, 地址或元数据变化时才算更新
+			old.TTL = options.TTL
+			old.LastSeen = time.Now()
+			if old.Address != n.Address || !metadataEqual(old.Metadata, n.Metadata) {
+				old.Node = copyNode(n)
+				changed = true
+			}
+			continue
+		}
+
+		r.Nodes[n.Id] = &node{
+			Node:     copyNode(n),
+			TTL:      options.TTL,
+			LastSeen: time.Now(),
+		}
+		changed = true
+	}
+
+	if !metadataEqual(r.Metadata, s.Metadata) {
+		r.Metadata = copyMetadata(s.Metadata)
+		changed = true
+	}
+	// 都经过复制再比较, nil 和空的元数据视为相同
+	if eps := copyEndpoints(s.Endpoints); !reflect.DeepEqual(r.Endpoints, eps) {
+		r.Endpoints = eps
+		changed = true
+	}
+
+	if changed {
+		m.sendEvent(registry.Update, r)
+	}
+
+	return nil
+}
+
+func (m *memRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	versions, ok := m.records[s.Name]
+	if !ok {
+		return nil
+	}
+
+	r, ok := versions[s.Version]
+	if !ok {
+		return nil
+	}
+
+	for _, n := range s.Nodes {
+		delete(r.Nodes, n.Id)
+	}
+
+	m.removeEmpty(r)
+	return nil
+}
+
+func (m *memRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	versions, ok := m.records[name]
+	if !ok || len(versions) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, r := range versions {
+		services = append(services, recordToService(r))
+	}
+
+	return services, nil
+}
+
+func (m *memRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var services []*registry.Service
+	for _, versions := range m.records {
+		for _, r := range versions {
+			services = append(services, recordToService(r))
+		}
+	}
+
+	return services, nil
+}
+
+func (m *memRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	w := &memWatcher{
+		id:   newWatcherId(),
+		wo:   wo,
+		res:  make(chan *registry.Result, 128),
+		exit: make(chan bool),
+	}
+
+	m.Lock()
+	m.watchers[w.id] = w
+	m.Unlock()
+
+	go func() {
+		var ctxDone <-chan struct{}
+		if wo.Context != nil {
+			ctxDone = wo.Context.Done()
+		}
+
+		select {
+		case <-w.exit:
+		case <-ctxDone:
+			w.Stop()
+		}
+
+		m.Lock()
+		delete(m.watchers, w.id)
+		m.Unlock()
+	}()
+
+	return w, nil
+}
+
+func (m *memRegistry) String() string {
+	return "memory"
+}
+
+// ttlPrune 定期删除心跳超时的节点
+func (m *memRegistry) ttlPrune() {
+	t := time.NewTicker(ttlPruneTime)
+	defer t.Stop()
+
+	var ctxDone <-chan struct{}
+	if m.opts.Context != nil {
+		ctxDone = m.opts.Context.Done()
+	}
+
+	for {
+		select {
+		case <-m.exit:
+			return
+		case <-ctxDone:
+			return
+		case <-t.C:
+		}
+
+		m.Lock()
+		for _, versions := range m.records {
+			for _, r := range versions {
+				expired := false
+				for id, n := range r.Nodes {
+					if n.TTL > 0 && time.Since(n.LastSeen) > n.TTL {
+						delete(r.Nodes, id)
+						expired = true
+					}
+				}
+				if expired {
+					m.removeEmpty(r)
+				}
+			}
+		}
+		m.Unlock()
+	}
+}
+
+// removeEmpty 在节点变化后发出事件, 没有节点的版本和服务会被删除. 调用方需持有锁.
+func (m *memRegistry) removeEmpty(r *record) {
+	if len(r.Nodes) > 0 {
+		m.sendEvent(registry.Update, r)
+		return
+	}
+
+	delete(m.records[r.Name], r.Version)
+	if len(m.records[r.Name]) == 0 {
+		delete(m.records, r.Name)
+	}
+
+	m.sendEvent(registry.Delete, r)
+}
+
+// sendEvent 通知所有关注该服务的 watcher. 调用方需持有锁.
+func (m *memRegistry) sendEvent(t registry.EventType, r *record) {
+	s := recordToService(r)
+	for _, w := range m.watchers {
+		if len(w.wo.Service) > 0 && w.wo.Service != r.Name {
+			continue
+		}
+
+		select {
+		case <-w.exit:
+		case w.res <- &registry.Result{Action: t.String(), Service: s}:
+		default:
+			// watcher 消费过慢时丢弃事件, 不阻塞注册
+			log.Warnf("memory registry watcher %s is full, drop %s event of %s %s", w.id, t, r.Name, r.Version)
+		}
+	}
+}
+
+// Close stops pruning the expired nodes, so the registry no longer holds a
+// goroutine. It is also stopped when the registry.Context is done.
+// The registry returned by NewRegistry implements io.Closer.
+func (m *memRegistry) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.exit)
+	})
+	return nil
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	options := registry.Options{
+		Context: context.Background(),
+	}
+
+	m := &memRegistry{
+		opts:     options,
+		records:  make(map[string]map[string]*record),
+		watchers: make(map[string]*memWatcher),
+		exit:     make(chan struct{}),
+	}
+
+	configure(m, opts...)
+
+	go m.ttlPrune()
+
+	return m
+}
@@ -0,0 +1,194 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/registrytest"
+)
+
+func testService(version string, ids ...string) *registry.Service {
+	s := &registry.Service{
+		Name:     "Greeter",
+		Version:  version,
+		Metadata: map[string]string{"owner": "base4go"},
+	}
+	for _, id := range ids {
+		s.Nodes = append(s.Nodes, &registry.Node{
+			Id:       id,
+			Address:  id + ":8080",
+			Metadata: map[string]string{"gray": "false"},
+		})
+	}
+	return s
+}
+
+func TestRegisterGetDeregister(t *testing.T) {
+	r := NewRegistry()
+
+	if err := r.Register(testService("v1", "a", "b")); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+	if err := r.Register(testService("v2", "c")); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(services))
+	}
+	for _, s := range services {
+		if s.Metadata["owner"] != "base4go" {
+			t.Errorf("service metadata lost: %v", s.Metadata)
+		}
+		if s.Version == "v1" && len(s.Nodes) != 2 {
+			t.Errorf("expected 2 nodes for v1, got %d", len(s.Nodes))
+		}
+		for _, n := range s.Nodes {
+			if n.Metadata["gray"] != "false" {
+				t.Errorf("node metadata lost: %v", n.Metadata)
+			}
+		}
+	}
+
+	list, err := r.ListServices()
+	if err != nil {
+		t.Fatalf("list services err: %v", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("expected 2 services, got %d", len(list))
+	}
+
+	if err := r.Deregister(testService("v1", "a", "b")); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+	if err := r.Deregister(testService("v2", "c")); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+
+	if _, err := r.GetService("Greeter"); !errors.Is(err, registry.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRegisterTTL(t *testing.T) {
+	r := NewRegistry()
+
+	if err := r.Register(testService("v1", "a"), registry.RegisterTTL(time.Millisecond*500)); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+	if err := r.Register(testService("v1", "b")); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	time.Sleep(ttlPruneTime + time.Second)
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != "b" {
+		t.Errorf("expected only node b to survive, got %+v", services)
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := NewRegistry()
+
+	if err := r.Register(testService("v1", "a"), registry.RegisterTTL(time.Millisecond*100)); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	c, ok := r.(io.Closer)
+	if !ok {
+		t.Fatal("memory registry should implement io.Closer")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close err: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close twice err: %v", err)
+	}
+
+	// 关闭后不再删除过期节点
+	time.Sleep(ttlPruneTime + 200*time.Millisecond)
+	if _, err := r.GetService("Greeter"); err != nil {
+		t.Errorf("expected node kept after close, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r := NewRegistry()
+
+	w, err := r.Watch(registry.WatchService("Greeter"))
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	defer w.Stop()
+
+	r.Register(testService("v1", "a"))
+	r.Register(testService("v1", "b"))
+	// 心跳不产生事件
+	r.Register(testService("v1", "b"))
+	// 只有接口变化也是更新
+	s := testService("v1", "b")
+	s.Endpoints = []*registry.Endpoint{{Name: "Greeter.SayHello"}}
+	r.Register(s)
+	r.Deregister(testService("v1", "a", "b"))
+
+	for _, action := range []string{"create", "update", "update", "delete"} {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatalf("next err: %v", err)
+		}
+		if res.Action != action {
+			t.Errorf("expected %s, got %s", action, res.Action)
+		}
+	}
+
+	w.Stop()
+	if _, err := w.Next(); !errors.Is(err, registry.ErrWatcherStopped) {
+		t.Errorf("expected ErrWatcherStopped, got %v", err)
+	}
+}
+
+func TestWatchStopConcurrent(t *testing.T) {
+	r := NewRegistry()
+
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		w, err := r.Watch(registry.WatchContext(ctx))
+		if err != nil {
+			t.Fatalf("watch err: %v", err)
+		}
+
+		// 取消 Context 和调用方同时 Stop
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				w.Stop()
+			}()
+		}
+		close(start)
+		cancel()
+		wg.Wait()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func() registry.Registry {
+		return NewRegistry()
+	})
+}
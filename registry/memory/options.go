@@ -0,0 +1,22 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// Define a custom type for context keys to avoid collisions.
+type contextKey string
+
+const servicesKey contextKey = "memory_services"
+
+// Services is an option that preloads service data.
+func Services(s map[string][]*registry.Service) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, servicesKey, s)
+	}
+}
@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+func serviceToRecord(s *registry.Service, ttl time.Duration) *record {
+	nodes := make(map[string]*node, len(s.Nodes))
+	for _, n := range s.Nodes {
+		nodes[n.Id] = &node{
+			Node:     copyNode(n),
+			TTL:      ttl,
+			LastSeen: time.Now(),
+		}
+	}
+
+	return &record{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  copyMetadata(s.Metadata),
+		Nodes:     nodes,
+		Endpoints: copyEndpoints(s.Endpoints),
+	}
+}
+
+func recordToService(r *record) *registry.Service {
+	nodes := make([]*registry.Node, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		nodes = append(nodes, copyNode(n.Node))
+	}
+
+	return &registry.Service{
+		Name:      r.Name,
+		Version:   r.Version,
+		Metadata:  copyMetadata(r.Metadata),
+		Endpoints: copyEndpoints(r.Endpoints),
+		Nodes:     nodes,
+	}
+}
+
+func copyNode(n *registry.Node) *registry.Node {
+	return &registry.Node{
+		Id:       n.Id,
+		Address:  n.Address,
+		Metadata: copyMetadata(n.Metadata),
+	}
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	cp := make(map[string]string, len(md))
+	for k, v := range md {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyEndpoints(eps []*registry.Endpoint) []*registry.Endpoint {
+	cp := make([]*registry.Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		e := *ep
+		e.Metadata = copyMetadata(ep.Metadata)
+		cp = append(cp, &e)
+	}
+	return cp
+}
+
+func metadataEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
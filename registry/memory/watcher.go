@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+var watcherSeq uint64
+
+func newWatcherId() string {
+	return strconv.FormatUint(atomic.AddUint64(&watcherSeq, 1), 10)
+}
+
+type memWatcher struct {
+	id   string
+	wo   registry.WatchOptions
+	res  chan *registry.Result
+	exit chan bool
+	once sync.Once
+}
+
+func (m *memWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-m.res:
+		return r, nil
+	case <-m.exit:
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+// Stop 可能同时被调用方和 Watch 中监听 Context 的 goroutine 调用
+func (m *memWatcher) Stop() {
+	m.once.Do(func() {
+		close(m.exit)
+	})
+}
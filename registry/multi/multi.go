@@ -0,0 +1,213 @@
+// Package multi provides a registry which registers to and discovers from
+// several registries at once, for example during a migration between backends.
+package multi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+type multiRegistry struct {
+	opts       registry.Options
+	registries []registry.Registry
+	policy     Policy
+}
+
+func configure(m *multiRegistry, opts ...registry.Option) {
+	for _, o := range opts {
+		o(&m.opts)
+	}
+
+	if m.opts.Context == nil {
+		return
+	}
+
+	if rs, ok := m.opts.Context.Value(registriesKey).([]registry.Registry); ok {
+		m.registries = rs
+	}
+
+	if p, ok := m.opts.Context.Value(policyKey).(Policy); ok {
+		m.policy = p
+	}
+}
+
+func (m *multiRegistry) Init(opts ...registry.Option) error {
+	configure(m, opts...)
+	return nil
+}
+
+func (m *multiRegistry) Options() registry.Options {
+	return m.opts
+}
+
+func (m *multiRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	return m.each(func(r registry.Registry) error {
+		return r.Register(s, opts...)
+	})
+}
+
+func (m *multiRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	return m.each(func(r registry.Registry) error {
+		return r.Deregister(s, opts...)
+	})
+}
+
+// each 对每个子注册中心执行 fn, 按 Policy 决定返回值
+func (m *multiRegistry) each(fn func(r registry.Registry) error) error {
+	if len(m.registries) == 0 {
+		return errors.New("no registries")
+	}
+
+	var errs []error
+	for _, r := range m.registries {
+		if err := fn(r); err != nil {
+			log.Errorf("multi registry %s err: %v", r.String(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", r.String(), err))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if m.policy == RequireAny && len(errs) < len(m.registries) {
+		return nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// GetService 合并所有子注册中心的结果, 按版本聚合, 相同节点 id 只保留一个.
+// 部分子注册中心出错时返回其余的结果, 全部出错时返回错误.
+func (m *multiRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var results [][]*registry.Service
+	var errs []error
+	notFound := 0
+
+	for _, r := range m.registries {
+		services, err := r.GetService(name, opts...)
+		if errors.Is(err, registry.ErrNotFound) {
+			notFound++
+			continue
+		}
+		if err != nil {
+			log.Errorf("multi registry %s get service %s err: %v", r.String(), name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", r.String(), err))
+			continue
+		}
+		results = append(results, services)
+	}
+
+	if len(results) == 0 {
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+		return nil, registry.ErrNotFound
+	}
+
+	services := merge(results...)
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return services, nil
+}
+
+func (m *multiRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var results [][]*registry.Service
+	var errs []error
+
+	for _, r := range m.registries {
+		services, err := r.ListServices(opts...)
+		if err != nil {
+			log.Errorf("multi registry %s list services err: %v", r.String(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", r.String(), err))
+			continue
+		}
+		results = append(results, services)
+	}
+
+	if len(results) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return merge(results...), nil
+}
+
+// Watch 合并所有子注册中心的事件, 每个事件都带有该版本在所有子注册中心中的节点
+func (m *multiRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newMultiWatcher(m.registries, opts...)
+}
+
+func (m *multiRegistry) String() string {
+	names := make([]string, 0, len(m.registries))
+	for _, r := range m.registries {
+		names = append(names, r.String())
+	}
+	return "multi[" + strings.Join(names, ",") + "]"
+}
+
+// merge 按 name/version 聚合服务, 相同节点 id 以先出现的为准
+func merge(results ...[]*registry.Service) []*registry.Service {
+	type key struct{ name, version string }
+
+	serviceMap := make(map[key]*registry.Service)
+	nodeSeen := make(map[key]map[string]bool)
+	var services []*registry.Service
+
+	for _, list := range results {
+		for _, s := range list {
+			k := key{s.Name, s.Version}
+
+			svc, ok := serviceMap[k]
+			if !ok {
+				svc = &registry.Service{
+					Name:      s.Name,
+					Version:   s.Version,
+					Metadata:  s.Metadata,
+					Endpoints: s.Endpoints,
+				}
+				serviceMap[k] = svc
+				nodeSeen[k] = make(map[string]bool)
+				services = append(services, svc)
+			}
+
+			if len(svc.Metadata) == 0 {
+				svc.Metadata = s.Metadata
+			}
+			if len(svc.Endpoints) == 0 {
+				svc.Endpoints = s.Endpoints
+			}
+
+			for _, n := range s.Nodes {
+				if nodeSeen[k][n.Id] {
+					continue
+				}
+				nodeSeen[k][n.Id] = true
+				svc.Nodes = append(svc.Nodes, n)
+			}
+		}
+	}
+
+	sort.SliceStable(services, func(i, j int) bool {
+		if services[i].Name == services[j].Name {
+			return services[i].Version < services[j].Version
+		}
+		return services[i].Name < services[j].Name
+	})
+
+	return services
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	m := &multiRegistry{
+		opts: registry.Options{},
+	}
+	configure(m, opts...)
+	return m
+}
@@ -0,0 +1,141 @@
+package multi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+	"github.com/robert-pkg/base4go/registry/registrytest"
+)
+
+type failRegistry struct {
+	registry.Registry
+}
+
+var errFail = errors.New("backend down")
+
+func (f *failRegistry) Register(*registry.Service, ...registry.RegisterOption) error {
+	return errFail
+}
+
+func (f *failRegistry) GetService(string, ...registry.GetOption) ([]*registry.Service, error) {
+	return nil, errFail
+}
+
+func (f *failRegistry) String() string {
+	return "fail"
+}
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func testService(ids ...string) *registry.Service {
+	s := &registry.Service{Name: "Greeter", Version: "v1"}
+	for _, id := range ids {
+		s.Nodes = append(s.Nodes, &registry.Node{Id: id, Address: id + ":8080"})
+	}
+	return s
+}
+
+func TestMergeGetService(t *testing.T) {
+	a := memory.NewRegistry()
+	b := memory.NewRegistry()
+	r := NewRegistry(Registries(a, b))
+
+	// 两边都有 node-1, 合并后只保留一个
+	a.Register(testService("node-1"))
+	b.Register(testService("node-1", "node-2"))
+
+	services, err := r.GetService("Greeter")
+	if err != nil {
+		t.Fatalf("get service err: %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 2 {
+		t.Fatalf("expected 1 version with 2 nodes, got %+v", services)
+	}
+
+	if _, err := r.GetService("Unknown"); !errors.Is(err, registry.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	good := memory.NewRegistry()
+	bad := &failRegistry{}
+
+	strict := NewRegistry(Registries(good, bad))
+	if err := strict.Register(testService("node-1")); !errors.Is(err, errFail) {
+		t.Errorf("expected RequireAll to fail, got %v", err)
+	}
+
+	lenient := NewRegistry(Registries(good, bad), FailurePolicy(RequireAny))
+	if err := lenient.Register(testService("node-1")); err != nil {
+		t.Errorf("expected RequireAny to succeed, got %v", err)
+	}
+
+	// 部分子注册中心出错时仍返回其余的结果
+	services, err := lenient.GetService("Greeter")
+	if err != nil || len(services) != 1 {
+		t.Errorf("expected results from the healthy registry, got %+v %v", services, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	a := memory.NewRegistry()
+	b := memory.NewRegistry()
+	r := NewRegistry(Registries(a, b))
+
+	w, err := r.Watch(registry.WatchService("Greeter"))
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+
+	if err := r.Register(testService("node-1")); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	for _, action := range []string{"create", "update"} {
+		res, err := w.Next()
+		if err != nil || res.Action != action || len(res.Service.Nodes) != 1 {
+			t.Errorf("expected %s with 1 node, got %v %v", action, res, err)
+		}
+	}
+
+	// 每个事件都带有所有子注册中心的节点
+	if err := b.Register(testService("node-2")); err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+	if res, err := w.Next(); err != nil || res.Action != "update" || len(res.Service.Nodes) != 2 {
+		t.Errorf("expected update with 2 nodes, got %v %v", res, err)
+	}
+
+	// 一个子注册中心删除的节点, 在另一个中仍然存在
+	if err := a.Deregister(testService("node-1")); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+	if res, err := w.Next(); err != nil || res.Action != "update" || len(res.Service.Nodes) != 2 {
+		t.Errorf("expected update with 2 nodes, got %v %v", res, err)
+	}
+
+	if err := b.Deregister(testService("node-1", "node-2")); err != nil {
+		t.Fatalf("deregister err: %v", err)
+	}
+	if res, err := w.Next(); err != nil || res.Action != "delete" {
+		t.Errorf("expected delete, got %v %v", res, err)
+	}
+
+	w.Stop()
+	if _, err := w.Next(); !errors.Is(err, registry.ErrWatcherStopped) {
+		t.Errorf("expected ErrWatcherStopped, got %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	registrytest.RunConformance(t, func() registry.Registry {
+		return NewRegistry(Registries(memory.NewRegistry(), memory.NewRegistry()))
+	})
+}
@@ -0,0 +1,44 @@
+package multi
+
+import (
+	"context"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// Define a custom type for context keys to avoid collisions.
+type contextKey string
+
+const registriesKey contextKey = "multi_registries"
+const policyKey contextKey = "multi_policy"
+
+// Policy decides when Register and Deregister are successful.
+type Policy int
+
+const (
+	// RequireAll fails if any child registry fails, this is the default.
+	RequireAll Policy = iota
+	// RequireAny succeeds if at least one child registry succeeds.
+	RequireAny
+)
+
+// Registries are the child registries. The order matters when merging
+// results, the node of the first registry wins for a duplicated node id.
+func Registries(rs ...registry.Registry) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, registriesKey, rs)
+	}
+}
+
+// FailurePolicy sets the Policy for Register and Deregister.
+func FailurePolicy(p Policy) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, policyKey, p)
+	}
+}
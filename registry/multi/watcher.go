@@ -0,0 +1,170 @@
+package multi
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+type serviceKey struct{ name, version string }
+
+// multiWatcher 按子注册中心分别保存服务的状态, 每收到一个子事件,
+// 都发出该 name/version 合并后的结果, 避免只看到一个注册中心的节点.
+type multiWatcher struct {
+	registries []registry.Registry
+	watchers   []registry.Watcher
+	next       chan *registry.Result
+	exit       chan bool
+
+	mu sync.Mutex
+	// 每个子注册中心: name/version -> service
+	state []map[serviceKey]*registry.Service
+	// 每个子注册中心: 已经从 GetService 取过全量的服务名
+	seeded []map[string]bool
+	// 已经发出过 create 的 name/version
+	created map[serviceKey]bool
+
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func newMultiWatcher(rs []registry.Registry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	mw := &multiWatcher{
+		registries: rs,
+		next:       make(chan *registry.Result),
+		exit:       make(chan bool),
+		created:    make(map[serviceKey]bool),
+	}
+
+	for _, r := range rs {
+		w, err := r.Watch(opts...)
+		if err != nil {
+			mw.Stop()
+			return nil, err
+		}
+		mw.watchers = append(mw.watchers, w)
+		mw.state = append(mw.state, make(map[serviceKey]*registry.Service))
+		mw.seeded = append(mw.seeded, make(map[string]bool))
+	}
+
+	for i, w := range mw.watchers {
+		mw.wg.Add(1)
+		go mw.forward(i, w)
+	}
+
+	return mw, nil
+}
+
+func (mw *multiWatcher) forward(i int, w registry.Watcher) {
+	defer mw.wg.Done()
+
+	for {
+		r, err := w.Next()
+		if err != nil {
+			// 子 watcher 停止后不再转发, 其余的继续工作
+			return
+		}
+		if r.Service == nil {
+			continue
+		}
+
+		if !mw.emit(i, r) {
+			return
+		}
+	}
+}
+
+// emit 发出合并后的结果. 计算和发送都在锁内, 保证结果按状态变化的顺序发出;
+// 返回 false 表示 watcher 已停止.
+func (mw *multiWatcher) emit(i int, r *registry.Result) bool {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	select {
+	case mw.next <- mw.apply(i, r):
+		return true
+	case <-mw.exit:
+		return false
+	}
+}
+
+// apply 用第 i 个子注册中心的事件更新它的状态, 返回合并后的结果. 调用方需持有锁.
+func (mw *multiWatcher) apply(i int, r *registry.Result) *registry.Result {
+	k := serviceKey{r.Service.Name, r.Service.Version}
+
+	// 其他子注册中心中已有的节点不会产生事件, 第一次遇到服务时取一次全量
+	for j := range mw.registries {
+		if j != i {
+			mw.seed(j, r.Service.Name)
+		}
+	}
+	mw.seeded[i][r.Service.Name] = true
+
+	if r.Action == registry.Delete.String() {
+		delete(mw.state[i], k)
+	} else {
+		mw.state[i][k] = r.Service
+	}
+
+	var results [][]*registry.Service
+	for _, st := range mw.state {
+		if s, ok := st[k]; ok {
+			results = append(results, []*registry.Service{s})
+		}
+	}
+
+	merged := merge(results...)
+	if len(merged) == 0 {
+		// 所有子注册中心都没有这个版本了
+		delete(mw.created, k)
+		return &registry.Result{Action: registry.Delete.String(), Service: r.Service}
+	}
+
+	action := registry.Update
+	if !mw.created[k] {
+		action = registry.Create
+		mw.created[k] = true
+	}
+	return &registry.Result{Action: action.String(), Service: merged[0]}
+}
+
+// seed 从第 j 个子注册中心取服务的全量, 调用方需持有锁
+func (mw *multiWatcher) seed(j int, name string) {
+	if mw.seeded[j][name] {
+		return
+	}
+	mw.seeded[j][name] = true
+
+	services, err := mw.registries[j].GetService(name)
+	if err != nil {
+		if !errors.Is(err, registry.ErrNotFound) {
+			log.Errorf("multi watcher %s get service %s err: %v", mw.registries[j].String(), name, err)
+		}
+		return
+	}
+
+	for _, s := range services {
+		mw.state[j][serviceKey{s.Name, s.Version}] = s
+	}
+}
+
+func (mw *multiWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-mw.next:
+		return r, nil
+	case <-mw.exit:
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+func (mw *multiWatcher) Stop() {
+	mw.once.Do(func() {
+		close(mw.exit)
+		for _, w := range mw.watchers {
+			w.Stop()
+		}
+	})
+	mw.wg.Wait()
+}
@@ -33,6 +33,15 @@ type ListOptions struct {
 	Context context.Context
 }
 
+type WatchOptions struct {
+	// Specify a service to watch
+	// If blank, the watch is for all services
+	Service string
+	// Other options for implementations of the interface
+	// can be stored in a context
+	Context context.Context
+}
+
 func NewOptions(opts ...Option) *Options {
 	options := Options{
 		Context: context.Background(),
@@ -87,3 +96,16 @@ func ListContext(ctx context.Context) ListOption {
 		o.Context = ctx
 	}
 }
+
+// WatchService is the name of the service to watch.
+func WatchService(name string) WatchOption {
+	return func(o *WatchOptions) {
+		o.Service = name
+	}
+}
+
+func WatchContext(ctx context.Context) WatchOption {
+	return func(o *WatchOptions) {
+		o.Context = ctx
+	}
+}
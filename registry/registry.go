@@ -22,6 +22,7 @@ type Registry interface {
 	Deregister(*Service, ...DeregisterOption) error
 	GetService(string, ...GetOption) ([]*Service, error)
 	ListServices(...ListOption) ([]*Service, error)
+	Watch(...WatchOption) (Watcher, error)
 	String() string
 }
 
@@ -62,6 +63,8 @@ type GetOption func(*GetOptions)
 
 type ListOption func(*ListOptions)
 
+type WatchOption func(*WatchOptions)
+
 // Register a service node. Additionally supply options such as TTL.
 func Register(s *Service, opts ...RegisterOption) error {
 	return DefaultRegistry.Register(s, opts...)
@@ -82,6 +85,11 @@ func ListServices() ([]*Service, error) {
 	return DefaultRegistry.ListServices()
 }
 
+// Watch returns a watcher which allows you to track updates to the registry.
+func Watch(opts ...WatchOption) (Watcher, error) {
+	return DefaultRegistry.Watch(opts...)
+}
+
 func String() string {
 	return DefaultRegistry.String()
 }
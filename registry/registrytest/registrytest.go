@@ -0,0 +1,462 @@
+// Package registrytest provides a conformance suite that every
+// registry.Registry implementation should pass.
+//
+//	func TestConformance(t *testing.T) {
+//		registrytest.RunConformance(t, func() registry.Registry {
+//			return NewRegistry()
+//		})
+//	}
+package registrytest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+type Options struct {
+	// TTL 是否测试心跳超时后节点被删除
+	TTL bool
+	// Watch 是否测试 Watch
+	Watch bool
+	// Timeout 等待注册中心最终一致的时间
+	Timeout time.Duration
+}
+
+type Option func(*Options)
+
+// SkipTTL skips the TTL expiry checks, for backends without heartbeats.
+func SkipTTL() Option {
+	return func(o *Options) {
+		o.TTL = false
+	}
+}
+
+// SkipWatch skips the watch checks, for backends that can't watch.
+func SkipWatch() Option {
+	return func(o *Options) {
+		o.Watch = false
+	}
+}
+
+// Timeout is how long to wait for a change to become visible, defaults to 10s.
+func Timeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// 每个用例使用不同的服务名, 以便在共享的注册中心上运行
+var seq int64
+
+func serviceName() string {
+	return fmt.Sprintf("registrytest-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&seq, 1))
+}
+
+// RunConformance runs the suite against registries created by newRegistry,
+// a new registry is created for every sub test.
+func RunConformance(t *testing.T, newRegistry func() registry.Registry, opts ...Option) {
+	options := Options{
+		TTL:     true,
+		Watch:   true,
+		Timeout: 10 * time.Second,
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	s := &suite{opts: options, newRegistry: newRegistry}
+
+	t.Run("RegisterGetDeregister", s.testRegisterGetDeregister)
+	t.Run("ListServices", s.testListServices)
+	t.Run("MetadataRoundTrip", s.testMetadataRoundTrip)
+	t.Run("MultipleNodes", s.testMultipleNodes)
+	t.Run("RequireNodes", s.testRequireNodes)
+
+	if options.TTL {
+		t.Run("TTLExpiry", s.testTTLExpiry)
+	}
+
+	if options.Watch {
+		t.Run("Watch", s.testWatch)
+	}
+}
+
+type suite struct {
+	opts        Options
+	newRegistry func() registry.Registry
+}
+
+func newService(name, version string, ids ...string) *registry.Service {
+	s := &registry.Service{
+		Name:    name,
+		Version: version,
+	}
+	for i, id := range ids {
+		s.Nodes = append(s.Nodes, &registry.Node{
+			Id:      id,
+			Address: fmt.Sprintf("127.0.0.1:%d", 10001+i),
+		})
+	}
+	return s
+}
+
+// deregister 在用例结束时清理, 忽略错误
+func deregister(t *testing.T, r registry.Registry, s *registry.Service) {
+	t.Cleanup(func() {
+		r.Deregister(s)
+	})
+}
+
+// getNodes 返回 version 到节点 id 的映射, 服务不存在时返回空
+func getNodes(r registry.Registry, name string) (map[string][]string, error) {
+	services, err := r.GetService(name)
+	if errors.Is(err, registry.ErrNotFound) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string][]string)
+	for _, s := range services {
+		if s.Name != name {
+			return nil, fmt.Errorf("GetService(%s) returned service %s", name, s.Name)
+		}
+		for _, n := range s.Nodes {
+			nodes[s.Version] = append(nodes[s.Version], n.Id)
+		}
+	}
+	for _, ids := range nodes {
+		sort.Strings(ids)
+	}
+
+	return nodes, nil
+}
+
+// eventually 在超时时间内反复执行 fn, 直到返回 nil
+func (s *suite) eventually(t *testing.T, timeout time.Duration, fn func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// expectNodes 等待服务的节点变成 want, want 为空表示服务不存在
+func (s *suite) expectNodes(t *testing.T, r registry.Registry, name string, want map[string][]string) {
+	t.Helper()
+
+	s.eventually(t, s.opts.Timeout, func() error {
+		got, err := getNodes(r, name)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("GetService(%s) nodes: got %v, want %v", name, got, want)
+		}
+		return nil
+	})
+}
+
+func (s *suite) testRegisterGetDeregister(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	svc := newService(name, "v1.0.0", "node-1")
+	deregister(t, r, svc)
+
+	if err := r.Register(svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{"v1.0.0": {"node-1"}})
+
+	services, err := r.GetService(name)
+	if err != nil {
+		t.Fatalf("GetService: %v", err)
+	}
+	if got := services[0].Nodes[0].Address; got != svc.Nodes[0].Address {
+		t.Fatalf("node address: got %s, want %s", got, svc.Nodes[0].Address)
+	}
+
+	// 重复注册不应该产生重复的节点
+	if err := r.Register(svc); err != nil {
+		t.Fatalf("Register again: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{"v1.0.0": {"node-1"}})
+
+	if err := r.Deregister(svc); err != nil {
+		t.Fatalf("Deregister: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{})
+}
+
+func (s *suite) testListServices(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	svc := newService(name, "v1.0.0", "node-1")
+	deregister(t, r, svc)
+
+	if err := r.Register(svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	s.eventually(t, s.opts.Timeout, func() error {
+		services, err := r.ListServices()
+		if err != nil {
+			return err
+		}
+		for _, ls := range services {
+			if ls.Name == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("ListServices doesn't contain %s", name)
+	})
+}
+
+func (s *suite) testMetadataRoundTrip(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	svc := newService(name, "v1.2.3-rc.1", "node-1")
+	svc.Metadata = map[string]string{"owner": "registrytest", "desc": "greeter 服务"}
+	svc.Nodes[0].Metadata = map[string]string{"gray": "true", "weight": "10"}
+	svc.Endpoints = []*registry.Endpoint{{
+		Name: "Greeter.SayHello",
+		Request: &registry.Value{
+			Name:   "SayHelloRequest",
+			Type:   "SayHelloRequest",
+			Values: []*registry.Value{{Name: "name", Type: "string"}},
+		},
+		Response: &registry.Value{Name: "SayHelloReply", Type: "SayHelloReply"},
+		Metadata: map[string]string{"stream": "false"},
+	}}
+	deregister(t, r, svc)
+
+	if err := r.Register(svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{"v1.2.3-rc.1": {"node-1"}})
+
+	services, err := r.GetService(name)
+	if err != nil {
+		t.Fatalf("GetService: %v", err)
+	}
+	got := services[0]
+
+	if got.Version != svc.Version {
+		t.Errorf("version: got %q, want %q", got.Version, svc.Version)
+	}
+	for k, v := range svc.Metadata {
+		if got.Metadata[k] != v {
+			t.Errorf("service metadata %s: got %q, want %q", k, got.Metadata[k], v)
+		}
+	}
+	for k, v := range svc.Nodes[0].Metadata {
+		if got.Nodes[0].Metadata[k] != v {
+			t.Errorf("node metadata %s: got %q, want %q", k, got.Nodes[0].Metadata[k], v)
+		}
+	}
+
+	if len(got.Endpoints) != 1 {
+		t.Fatalf("endpoints: got %d, want 1", len(got.Endpoints))
+	}
+	e := got.Endpoints[0]
+	if e.Name != "Greeter.SayHello" || e.Request == nil || e.Request.Type != "SayHelloRequest" ||
+		len(e.Request.Values) != 1 || e.Response == nil || e.Response.Type != "SayHelloReply" ||
+		e.Metadata["stream"] != "false" {
+		t.Errorf("endpoint not round tripped: %+v", e)
+	}
+}
+
+func (s *suite) testMultipleNodes(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	v1 := newService(name, "v1", "node-1", "node-2")
+	v2 := newService(name, "v2", "node-3")
+	v2.Nodes[0].Address = "127.0.0.1:10003"
+	deregister(t, r, v1)
+	deregister(t, r, v2)
+
+	if err := r.Register(v1); err != nil {
+		t.Fatalf("Register v1: %v", err)
+	}
+	if err := r.Register(v2); err != nil {
+		t.Fatalf("Register v2: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{
+		"v1": {"node-1", "node-2"},
+		"v2": {"node-3"},
+	})
+
+	// 注销一个节点不影响其他节点
+	if err := r.Deregister(newService(name, "v1", "node-1")); err != nil {
+		t.Fatalf("Deregister node-1: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{
+		"v1": {"node-2"},
+		"v2": {"node-3"},
+	})
+}
+
+func (s *suite) testRequireNodes(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	if err := r.Register(&registry.Service{Name: name, Version: "v1"}); err == nil {
+		t.Error("Register without nodes should fail")
+	}
+	if err := r.Deregister(&registry.Service{Name: name, Version: "v1"}); err == nil {
+		t.Error("Deregister without nodes should fail")
+	}
+}
+
+func (s *suite) testTTLExpiry(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	const ttl = 3 * time.Second
+
+	svc := newService(name, "v1", "node-1")
+	deregister(t, r, svc)
+
+	if err := r.Register(svc, registry.RegisterTTL(ttl)); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	s.expectNodes(t, r, name, map[string][]string{"v1": {"node-1"}})
+
+	// 不再续约, 节点应该在 ttl 之后消失
+	s.eventually(t, ttl+s.opts.Timeout, func() error {
+		got, err := getNodes(r, name)
+		if err != nil {
+			return err
+		}
+		if len(got) != 0 {
+			return fmt.Errorf("node not expired after ttl: %v", got)
+		}
+		return nil
+	})
+}
+
+// watchResults 把 watcher 的结果转到 channel, watcher 停止后关闭 channel
+func watchResults(w registry.Watcher) <-chan *registry.Result {
+	ch := make(chan *registry.Result, 16)
+	go func() {
+		defer close(ch)
+		for {
+			res, err := w.Next()
+			if err != nil {
+				return
+			}
+			ch <- res
+		}
+	}()
+	return ch
+}
+
+// nextResult 等待第一个满足 match 的结果, 跳过其他结果
+func (s *suite) nextResult(t *testing.T, ch <-chan *registry.Result, desc string, match func(*registry.Result) bool) *registry.Result {
+	t.Helper()
+
+	timer := time.NewTimer(s.opts.Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case res, ok := <-ch:
+			if !ok {
+				t.Fatalf("watcher stopped while waiting for %s", desc)
+			}
+			if res.Service != nil && match(res) {
+				return res
+			}
+		case <-timer.C:
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+	}
+}
+
+func nodeIds(s *registry.Service) []string {
+	ids := make([]string, 0, len(s.Nodes))
+	for _, n := range s.Nodes {
+		ids = append(ids, n.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *suite) testWatch(t *testing.T) {
+	r := s.newRegistry()
+	name := serviceName()
+
+	w, err := r.Watch(registry.WatchService(name))
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer w.Stop()
+	ch := watchResults(w)
+
+	svc := newService(name, "v1", "node-1", "node-2")
+	deregister(t, r, svc)
+
+	if err := r.Register(newService(name, "v1", "node-1")); err != nil {
+		t.Fatalf("Register node-1: %v", err)
+	}
+	res := s.nextResult(t, ch, "create of v1", func(res *registry.Result) bool {
+		return res.Service.Name == name && res.Service.Version == "v1"
+	})
+	if res.Action != registry.Create.String() {
+		t.Errorf("first event action: got %s, want %s", res.Action, registry.Create)
+	}
+	if got := nodeIds(res.Service); fmt.Sprint(got) != "[node-1]" {
+		t.Errorf("create event nodes: got %v, want [node-1]", got)
+	}
+
+	// 新增节点时, 事件带上该版本当前的全部节点
+	if err := r.Register(svc); err != nil {
+		t.Fatalf("Register node-2: %v", err)
+	}
+	res = s.nextResult(t, ch, "update with node-2", func(res *registry.Result) bool {
+		return res.Service.Name == name && len(res.Service.Nodes) == 2
+	})
+	if res.Action != registry.Update.String() {
+		t.Errorf("add node action: got %s, want %s", res.Action, registry.Update)
+	}
+	if got := nodeIds(res.Service); fmt.Sprint(got) != "[node-1 node-2]" {
+		t.Errorf("update event nodes: got %v, want [node-1 node-2]", got)
+	}
+
+	// 其他服务的变化不应该被收到
+	other := newService(serviceName(), "v1", "other-1")
+	deregister(t, r, other)
+	if err := r.Register(other); err != nil {
+		t.Fatalf("Register other: %v", err)
+	}
+
+	if err := r.Deregister(svc); err != nil {
+		t.Fatalf("Deregister: %v", err)
+	}
+	s.nextResult(t, ch, "delete of v1", func(res *registry.Result) bool {
+		if res.Service.Name != name {
+			t.Errorf("received event of unwatched service %s", res.Service.Name)
+			return false
+		}
+		return res.Action == registry.Delete.String() && res.Service.Version == "v1"
+	})
+}
@@ -0,0 +1,42 @@
+package registry
+
+// Watcher is an interface that returns updates
+// about services within the registry.
+type Watcher interface {
+	// Next is a blocking call
+	Next() (*Result, error)
+	Stop()
+}
+
+// Result is returned by a call to Next on
+// the watcher. Actions can be create, update, delete.
+type Result struct {
+	Service *Service
+	Action  string
+}
+
+// EventType defines registry event type.
+type EventType int
+
+const (
+	// Create is emitted when a new service is registered.
+	Create EventType = iota
+	// Delete is emitted when an existing service is deregistered.
+	Delete
+	// Update is emitted when an existing service is updated.
+	Update
+)
+
+// String returns human readable event type.
+func (t EventType) String() string {
+	switch t {
+	case Create:
+		return "create"
+	case Delete:
+		return "delete"
+	case Update:
+		return "update"
+	default:
+		return "unknown"
+	}
+}
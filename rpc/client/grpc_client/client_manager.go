@@ -11,13 +11,16 @@ type ClientMgr interface {
 	GetClient(target string) (client.Client, error)
 }
 
-func GetClientMgr() ClientMgr {
+// GetClientMgr returns a ClientMgr which creates the clients with opts.
+func GetClientMgr(opts ...client.Option) ClientMgr {
 	return &clientMgr{
+		opts:    opts,
 		clients: make(map[string]client.Client),
 	}
 }
 
 type clientMgr struct {
+	opts    []client.Option
 	mu      sync.RWMutex
 	clients map[string]client.Client
 }
@@ -37,7 +40,7 @@ func (cm *clientMgr) GetClient(target string) (client.Client, error) {
 		return c, nil
 	}
 
-	cl := NewClient(target)
+	cl := NewClient(target, cm.opts...)
 	if err := cl.Init(); err != nil {
 		log.Infof("init client failed. target: %s, err: %v", target, err)
 		return nil, err
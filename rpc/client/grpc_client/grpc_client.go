@@ -6,6 +6,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/resolver"
 
 	//"github.com/robert-pkg/base4go/registry"
 	"github.com/robert-pkg/base4go/log"
@@ -14,12 +15,18 @@ import (
 	_ "github.com/robert-pkg/base4go/rpc/grpc/codec/json"
 	"github.com/robert-pkg/base4go/rpc/grpc/interceptor"
 	consul_resolver "github.com/robert-pkg/base4go/rpc/grpc/resolver/consul_resolver"
+	direct_resolver "github.com/robert-pkg/base4go/rpc/grpc/resolver/direct_resolver"
+	registry_resolver "github.com/robert-pkg/base4go/rpc/grpc/resolver/registry_resolver"
+	srv_resolver "github.com/robert-pkg/base4go/rpc/grpc/resolver/srv_resolver"
 )
 
 type grpcClient struct {
 	Target string
 	opts   client.Options
 
+	// 只对本客户端生效的 resolver, 不同客户端的注册中心和选项互不影响
+	resolvers []resolver.Builder
+
 	conn *grpc.ClientConn
 }
 
@@ -28,16 +35,33 @@ func (g *grpcClient) configure(opts ...client.Option) {
 		o(&g.opts)
 	}
 
-	consul_resolver.Register(g.opts.Registry)
+	var resolverOpts []consul_resolver.Option
+	if g.opts.Context != nil {
+		resolverOpts, _ = g.opts.Context.Value(consulResolverOptionsKey{}).([]consul_resolver.Option)
+	}
 
+	g.resolvers = []resolver.Builder{
+		consul_resolver.NewBuilder(g.opts.Registry, resolverOpts...),
+		registry_resolver.NewBuilder(g.opts.Registry),
+		direct_resolver.NewBuilder(),
+		srv_resolver.NewBuilder(),
+	}
 }
 
 func (g *grpcClient) Init() error {
 
+	lbConfig := "{}"
+	if g.opts.Context != nil {
+		if v, ok := g.opts.Context.Value(grayFallbackKey{}).(bool); ok {
+			lbConfig = fmt.Sprintf(`{"grayFallback":%t}`, v)
+		}
+	}
+
 	grpc_dial_opts := []grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()), // 不使用 TLS（明文连接）
+		grpc.WithResolvers(g.resolvers...),
 		grpc.WithDefaultServiceConfig(fmt.Sprintf(
-			`{"loadBalancingConfig": [{"%s":{}}]}`, balance.BalancerName)),
+			`{"loadBalancingConfig": [{"%s":%s}]}`, balance.BalancerName, lbConfig)),
 		//grpc.WithNoProxy(), // 禁用代理，直接连接到后端
 		grpc.WithDefaultCallOptions(grpc.ForceCodecV2(encoding.GetCodecV2("json"))),
 		grpc.WithChainUnaryInterceptor(
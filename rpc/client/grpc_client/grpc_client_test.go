@@ -0,0 +1,66 @@
+package grpc_client
+
+import (
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/internal/testutil/resolvertest"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+	"github.com/robert-pkg/base4go/rpc/client"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+// resolve 用客户端自己的 registry resolver 解析 Greeter
+func resolve(t *testing.T, g *grpcClient) *resolvertest.ClientConn {
+	t.Helper()
+
+	for _, b := range g.resolvers {
+		if b.Scheme() != "registry" {
+			continue
+		}
+
+		cc := &resolvertest.ClientConn{}
+		r, err := b.Build(resolver.Target{URL: url.URL{Scheme: "registry", Host: "Greeter"}}, cc, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatalf("build err: %v", err)
+		}
+		t.Cleanup(r.Close)
+		return cc
+	}
+
+	t.Fatal("no registry resolver")
+	return nil
+}
+
+func TestResolversPerClient(t *testing.T) {
+	newRegistry := func(addr string) registry.Registry {
+		r := memory.NewRegistry()
+		r.Register(&registry.Service{
+			Name:    "Greeter",
+			Version: "v1",
+			Nodes:   []*registry.Node{{Id: addr, Address: addr}},
+		})
+		return r
+	}
+
+	a := newGRPCClient("registry://Greeter", client.Registry(newRegistry("10.0.0.1:9000")))
+	b := newGRPCClient("registry://Greeter", client.Registry(newRegistry("10.0.0.2:9000")))
+
+	// 不能注册到全局, 否则后创建的客户端会覆盖之前的
+	for _, scheme := range []string{"consul", "registry", "direct", "srv"} {
+		if resolver.Get(scheme) != nil {
+			t.Errorf("resolver %s registered globally", scheme)
+		}
+	}
+
+	resolvertest.WaitAddrs(t, resolve(t, a), "10.0.0.1:9000")
+	resolvertest.WaitAddrs(t, resolve(t, b), "10.0.0.2:9000")
+}
@@ -0,0 +1,33 @@
+package grpc_client
+
+import (
+	"context"
+
+	"github.com/robert-pkg/base4go/rpc/client"
+	consul_resolver "github.com/robert-pkg/base4go/rpc/grpc/resolver/consul_resolver"
+)
+
+func setClientOption(k, v interface{}) client.Option {
+	return func(o *client.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+type consulResolverOptionsKey struct{}
+
+// ConsulResolverOptions configures the consul:// resolver, such as how
+// long the previous addresses are kept when no node is passing.
+func ConsulResolverOptions(opts ...consul_resolver.Option) client.Option {
+	return setClientOption(consulResolverOptionsKey{}, opts)
+}
+
+type grayFallbackKey struct{}
+
+// GrayFallback sets whether gray requests (metadata gray=true) go to the
+// normal nodes when no gray node is available, defaults to true.
+func GrayFallback(fallback bool) client.Option {
+	return setClientOption(grayFallbackKey{}, fallback)
+}
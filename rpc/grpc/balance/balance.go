@@ -1,53 +1,139 @@
 package balance
 
 import (
+	"encoding/json"
 	"math/rand"
 	"sync/atomic"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	grpc_metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 
 	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/addrattr"
 )
 
 // 参考： github.com/grpc/grpc-go/balancer/roundrobin/roundrobin.go
 const BalancerName = "z_round_robin"
 
+// GrayKey 既是请求的 metadata, 也是节点的元数据, 值为 "true" 表示灰度.
+// 灰度请求只发往灰度节点, 普通请求不会发往灰度节点.
+const GrayKey = "gray"
+
 func newBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(BalancerName, &builder{}, base.Config{HealthCheck: true})
+	return &lbBuilder{}
 }
 
 func init() {
 	balancer.Register(newBuilder())
 }
 
-type builder struct{}
+// Config 是 service config 中 z_round_robin 的配置, 例如
+//
+//	{"loadBalancingConfig": [{"z_round_robin": {"grayFallback": false}}]}
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// GrayFallback 没有可用的灰度节点时, 灰度请求是否发往普通节点, 默认 true
+	GrayFallback *bool `json:"grayFallback,omitempty"`
+}
+
+// lbBuilder 为每个连接创建一个 base 的 balancer, 并读取它的配置
+type lbBuilder struct{}
+
+func (*lbBuilder) Name() string {
+	return BalancerName
+}
+
+func (*lbBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &builder{}
+	pb.grayFallback.Store(true)
+
+	return &lbBalancer{
+		Balancer: base.NewBalancerBuilder(BalancerName, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+func (*lbBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+type lbBalancer struct {
+	balancer.Balancer
+	pb *builder
+}
+
+func (b *lbBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok && cfg.GrayFallback != nil {
+		b.pb.grayFallback.Store(*cfg.GrayFallback)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+type builder struct {
+	grayFallback atomic.Bool
+}
 
 func (bb *builder) Build(info base.PickerBuildInfo) balancer.Picker {
 	if len(info.ReadySCs) == 0 {
 		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
 
-	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
-	for sc, _ := range info.ReadySCs {
-		scs = append(scs, sc)
+	// 按节点元数据分为灰度和普通两组
+	var gray, normal []balancer.SubConn
+	for sc, sci := range info.ReadySCs {
+		if addrattr.NodeMetadata(sci.Address)[GrayKey] == "true" {
+			gray = append(gray, sc)
+		} else {
+			normal = append(normal, sc)
+		}
+	}
+
+	return &picker{
+		gray:         newSubConns(gray),
+		normal:       newSubConns(normal),
+		grayFallback: bb.grayFallback.Load(),
 	}
+}
+
+// subConns 在一组 SubConn 中轮询
+type subConns struct {
+	scs  []balancer.SubConn
+	next uint32
+}
 
-	picker := &picker{subConns: scs}
+func newSubConns(scs []balancer.SubConn) *subConns {
+	s := &subConns{scs: scs}
 	if len(scs) > 0 {
 		// Start at a random index, as the same RR balancer rebuilds a new
 		// picker when SubConn states change, and we don't want to apply excess
 		// load to the first server in the list.
-		picker.next = uint32(rand.Intn(len(scs)))
+		s.next = uint32(rand.Intn(len(scs)))
 	}
+	return s
+}
 
-	return picker
+func (s *subConns) pick() balancer.SubConn {
+	subConnsLen := uint32(len(s.scs))
+	nextIndex := atomic.AddUint32(&s.next, 1)
+
+	if nextIndex > 100000000 {
+		atomic.StoreUint32(&s.next, 0)
+	}
+	return s.scs[nextIndex%subConnsLen]
 }
 
 type picker struct {
-	subConns []balancer.SubConn
-	next     uint32
+	gray, normal *subConns
+	grayFallback bool
 }
 
 func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
@@ -56,25 +142,25 @@ func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 
 	isGray := false
 	if ok {
-		if gray := md.Get("gray"); len(gray) > 0 && gray[0] == "true" {
+		if gray := md.Get(GrayKey); len(gray) > 0 && gray[0] == "true" {
 			isGray = true
 		}
+	}
 
-		if isGray {
-			log.Infof("灰度")
+	if isGray {
+		if len(p.gray.scs) > 0 {
+			log.Debugf("灰度")
+			return balancer.PickResult{SubConn: p.gray.pick()}, nil
+		}
+		if !p.grayFallback {
+			return balancer.PickResult{}, status.Error(codes.Unavailable, "no gray node available")
 		}
 	}
 
-	if len(p.subConns) > 0 {
-		subConnsLen := uint32(len(p.subConns))
-		nextIndex := atomic.AddUint32(&p.next, 1)
-
-		if nextIndex > 100000000 {
-			atomic.StoreUint32(&p.next, 0)
-		}
-		sc := p.subConns[nextIndex%subConnsLen]
-		return balancer.PickResult{SubConn: sc}, nil
+	if len(p.normal.scs) > 0 {
+		return balancer.PickResult{SubConn: p.normal.pick()}, nil
 	}
 
-	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	// 只有灰度节点, 普通请求不发往灰度节点
+	return balancer.PickResult{}, status.Error(codes.Unavailable, "no normal node available, only gray nodes")
 }
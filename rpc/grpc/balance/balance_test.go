@@ -0,0 +1,109 @@
+package balance
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	grpc_metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/addrattr"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+func buildInfo(addrs map[string]bool) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for addr, gray := range addrs {
+		node := &registry.Node{Id: addr, Address: addr}
+		if gray {
+			node.Metadata = map[string]string{GrayKey: "true"}
+		}
+
+		info.ReadySCs[&testSubConn{addr: addr}] = base.SubConnInfo{Address: resolver.Address{
+			Addr:       addr,
+			Attributes: addrattr.New(&registry.Service{Name: "Greeter"}, node),
+		}}
+	}
+	return info
+}
+
+// picks 返回多次选择到的地址, 出错时返回 err
+func picks(p balancer.Picker, gray bool) (map[string]int, error) {
+	ctx := context.Background()
+	if gray {
+		ctx = grpc_metadata.AppendToOutgoingContext(ctx, GrayKey, "true")
+	}
+
+	got := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			return nil, err
+		}
+		got[res.SubConn.(*testSubConn).addr]++
+	}
+	return got, nil
+}
+
+func TestGrayRouting(t *testing.T) {
+	b := &builder{}
+	b.grayFallback.Store(true)
+
+	p := b.Build(buildInfo(map[string]bool{"a:1": false, "b:1": false, "g:1": true}))
+
+	got, err := picks(p, false)
+	if err != nil || got["g:1"] != 0 || got["a:1"] != 5 || got["b:1"] != 5 {
+		t.Errorf("normal requests should round robin over normal nodes, got %v %v", got, err)
+	}
+
+	got, err = picks(p, true)
+	if err != nil || got["g:1"] != 10 {
+		t.Errorf("gray requests should only go to gray nodes, got %v %v", got, err)
+	}
+
+	// 没有灰度节点时, 灰度请求发往普通节点
+	p = b.Build(buildInfo(map[string]bool{"a:1": false}))
+	if got, err := picks(p, true); err != nil || got["a:1"] != 10 {
+		t.Errorf("gray requests should fall back to normal nodes, got %v %v", got, err)
+	}
+
+	b.grayFallback.Store(false)
+	p = b.Build(buildInfo(map[string]bool{"a:1": false}))
+	if _, err := picks(p, true); err == nil {
+		t.Errorf("expected err without fallback")
+	}
+
+	// 只有灰度节点时, 普通请求不发往灰度节点
+	p = b.Build(buildInfo(map[string]bool{"g:1": true}))
+	if _, err := picks(p, false); err == nil {
+		t.Errorf("expected err for normal requests with only gray nodes")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := newBuilder().(balancer.ConfigParser).ParseConfig([]byte(`{"grayFallback": false}`))
+	if err != nil {
+		t.Fatalf("parse config err: %v", err)
+	}
+	if c := cfg.(*Config); c.GrayFallback == nil || *c.GrayFallback {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	cfg, err = newBuilder().(balancer.ConfigParser).ParseConfig([]byte(`{}`))
+	if err != nil || cfg.(*Config).GrayFallback != nil {
+		t.Errorf("unexpected config %+v %v", cfg, err)
+	}
+}
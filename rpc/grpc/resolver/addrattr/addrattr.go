@@ -0,0 +1,67 @@
+// Package addrattr defines the resolver.Address attributes set by the
+// base4go resolvers, so balancers can read the version and metadata of a node.
+package addrattr
+
+import (
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+const (
+	// VersionKey is the service version, a string.
+	VersionKey = "version"
+	// MetadataKey is the service metadata, a Metadata.
+	MetadataKey = "metadata"
+	// NodeMetadataKey is the node metadata, a Metadata.
+	NodeMetadataKey = "node_metadata"
+)
+
+// Metadata is a metadata map that can be compared by grpc,
+// a plain map would panic when attributes are compared.
+type Metadata map[string]string
+
+func (m Metadata) Equal(o any) bool {
+	om, ok := o.(Metadata)
+	if !ok || len(m) != len(om) {
+		return false
+	}
+
+	for k, v := range m {
+		if ov, ok := om[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// New returns the attributes of a node.
+func New(s *registry.Service, n *registry.Node) *attributes.Attributes {
+	attr := attributes.New(VersionKey, s.Version)
+	if len(s.Metadata) > 0 {
+		attr = attr.WithValue(MetadataKey, Metadata(s.Metadata))
+	}
+	if len(n.Metadata) > 0 {
+		attr = attr.WithValue(NodeMetadataKey, Metadata(n.Metadata))
+	}
+	return attr
+}
+
+// Version returns the service version of addr.
+func Version(addr resolver.Address) string {
+	v, _ := addr.Attributes.Value(VersionKey).(string)
+	return v
+}
+
+// ServiceMetadata returns the service metadata of addr, nil if none.
+func ServiceMetadata(addr resolver.Address) Metadata {
+	md, _ := addr.Attributes.Value(MetadataKey).(Metadata)
+	return md
+}
+
+// NodeMetadata returns the node metadata of addr, nil if none.
+func NodeMetadata(addr resolver.Address) Metadata {
+	md, _ := addr.Attributes.Value(NodeMetadataKey).(Metadata)
+	return md
+}
@@ -0,0 +1,34 @@
+package addrattr
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+func TestAttributes(t *testing.T) {
+	s := &registry.Service{Version: "v1", Metadata: map[string]string{"owner": "base4go"}}
+	n := &registry.Node{Metadata: map[string]string{"gray": "true"}}
+
+	a := resolver.Address{Addr: "127.0.0.1:1001", Attributes: New(s, n)}
+	if Version(a) != "v1" || ServiceMetadata(a)["owner"] != "base4go" || NodeMetadata(a)["gray"] != "true" {
+		t.Fatalf("unexpected attributes: %v", a.Attributes)
+	}
+
+	// 元数据是 map, grpc 比较地址时不能 panic
+	b := resolver.Address{Addr: "127.0.0.1:1001", Attributes: New(s, n)}
+	if !a.Equal(b) {
+		t.Error("same node should be equal")
+	}
+
+	n2 := &registry.Node{Metadata: map[string]string{"gray": "false"}}
+	if a.Equal(resolver.Address{Addr: "127.0.0.1:1001", Attributes: New(s, n2)}) {
+		t.Error("different node metadata should not be equal")
+	}
+
+	if NodeMetadata(resolver.Address{}) != nil {
+		t.Error("address without attributes should have no metadata")
+	}
+}
@@ -2,28 +2,37 @@ package consul_resolver
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
-	consul_api "github.com/hashicorp/consul/api"
-	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/resolver"
 
 	"github.com/robert-pkg/base4go/log"
 	"github.com/robert-pkg/base4go/registry"
-	consul_registry "github.com/robert-pkg/base4go/registry/consul"
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/addrattr"
 )
 
-func Register(r registry.Registry) {
-	resolver.Register(&consulResolverBuilder{
-		r: r,
-	})
+// Register registers a builder for the consul scheme globally, it must only
+// be called during initialization. Clients with their own registry or options
+// should pass NewBuilder to grpc.WithResolvers instead.
+func Register(r registry.Registry, opts ...Option) {
+	resolver.Register(NewBuilder(r, opts...))
+}
+
+// NewBuilder returns a builder for the consul scheme, to be passed to grpc.WithResolvers.
+func NewBuilder(r registry.Registry, opts ...Option) resolver.Builder {
+	return &consulResolverBuilder{
+		r:    r,
+		opts: newOptions(opts...),
+	}
 }
 
 type consulResolverBuilder struct {
-	r registry.Registry
+	r    registry.Registry
+	opts Options
 }
 
 func (*consulResolverBuilder) Scheme() string {
@@ -40,193 +49,249 @@ func (b *consulResolverBuilder) Build(target resolver.Target, cc resolver.Client
 		return nil, err
 	}
 
-	var svc, dc string
-	if true {
-		split := strings.Split(trgt, ".")
-		if len(split) == 1 {
-			svc = split[0]
-		} else if len(split) == 2 {
-			svc, dc = split[0], split[1]
-		} else {
-			return nil, fmt.Errorf("url '%s' err. Must be in the next format: '%s://service{.dc}'", trgt, b.Scheme())
-		}
+	query := target.URL.Query()
+	svc, dcs, err := parseTarget(trgt, query)
+	if err != nil {
+		return nil, fmt.Errorf("url '%s' err: %v. Must be in the next format: '%s://service{.dc}' or '%s://service?dc=dc1&failover=dc2,dc3'", target.URL.String(), err, b.Scheme(), b.Scheme())
+	}
+
+	filter, err := parseFilter(query)
+	if err != nil {
+		log.Errorf("consul resolver target '%s' err: %v", target.URL.String(), err)
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	r := &consulResolver{
-		registry: b.r,
-		svc:      svc,
-		dc:       dc,
-		ctx:      ctx,
-		cancel:   cancel,
-		cc:       cc,
+		svc:    svc,
+		dcs:    dcs,
+		filter: filter,
+		opts:   b.opts,
+		ctx:    ctx,
+		cancel: cancel,
+		cc:     cc,
+
+		results: make([][]*registry.Service, len(dcs)),
+		known:   make([]bool, len(dcs)),
+		failed:  make([]bool, len(dcs)),
+		start:   time.Now(),
+		changed: make(chan struct{}, 1),
+		addrMap: make(map[string]string),
+	}
+
+	r.snapshot = getSnapshotFile(b.opts.Snapshot)
+	for _, dc := range dcs {
+		w := acquireWatch(b.r, svc, dc)
+		r.watches = append(r.watches, w)
+		r.updates = append(r.updates, w.subscribe())
+	}
+
+	// 还没有查询结果时, 先使用快照中的地址
+	var seed []*registry.Service
+	if !r.watches[0].answered() {
+		seed = r.snapshot.load(r.svcString())
+	}
 
-		addrMap: make(map[string]*registry.Service),
+	for i := range r.updates {
+		r.wg.Add(1)
+		go r.forward(i)
 	}
 
 	r.wg.Add(1)
-	go r.watcher()
+	go r.watcher(seed)
 	return r, nil
 }
 
 // consulResolver implements resolver.Resolver
 type consulResolver struct {
-	registry registry.Registry
-	svc, dc  string
-	ctx      context.Context
-	cancel   context.CancelFunc
-	cc       resolver.ClientConn
-
-	addrMap map[string]*registry.Service
+	svc    string
+	dcs    []string // 按优先级排列的机房, 第一个为主机房
+	filter *nodeFilter
+	opts   Options
+	ctx    context.Context
+	cancel context.CancelFunc
+	cc     resolver.ClientConn
+
+	// 每个机房共享的阻塞查询, 以及它投递结果的 channel
+	watches []*serviceWatch
+	updates []chan watchResult
+
+	// 每个机房最近一次的结果, 有变化时通知 changed
+	mu        sync.Mutex
+	results   [][]*registry.Service
+	known     []bool    // 机房是否已经有过结果
+	failed    []bool    // 机房还没有过结果, 且查询出错
+	start     time.Time // 超过 FailoverWait 后, 查询出错的机房按没有可用节点处理
+	changed   chan struct{}
+	activeIdx int
+
+	// address -> nodeIdentity
+	addrMap map[string]string
+
+	// 地址为空或大量减少时, 保留之前的地址
+	protectSince time.Time
+	graceTimer   *time.Timer
+	pending      []*registry.Service
+	pendingDC    int // pending 来自的机房
+
+	snapshot *snapshotFile
+	seeding  bool // 正在使用快照中的地址, 不回写快照
 
 	wg sync.WaitGroup
 }
 
 func (r *consulResolver) svcString() string {
 	svc := r.svc
-	if r.dc != "" {
-		svc += "." + r.dc
+	if r.dcs[0] != "" {
+		svc += "." + r.dcs[0]
 	}
 
 	return svc
 }
 
-func (r *consulResolver) watcher() {
-	//log.Infof("consulResolver.watcher enter. dc:%s svc:%s", r.dc, r.svc)
-
+func (r *consulResolver) watcher(seed []*registry.Service) {
 	defer r.wg.Done()
 
-	var lastIndex uint64
-	errCnt := 0
+	if len(seed) > 0 {
+		r.seeding = true
+		r.update(0, seed)
+		r.seeding = false
+	}
+
+	// 等待到期时重新选择机房, 越过一直出错的机房
+	var waitC <-chan time.Time
+	if len(r.dcs) > 1 {
+		t := time.NewTimer(time.Until(r.start.Add(r.opts.FailoverWait)))
+		defer t.Stop()
+		waitC = t.C
+	}
+
 	for {
 		select {
 		case <-r.ctx.Done():
-			{
-				log.Infof("consulResolver.watcher ctx.Done. so exit")
-				return
+			return
+		case <-r.changed:
+			if dc, ss, ok := r.active(); ok {
+				r.update(dc, ss)
+			}
+		case <-waitC:
+			waitC = nil
+			if dc, ss, ok := r.active(); ok {
+				r.update(dc, ss)
 			}
-		default:
+		case <-r.graceC():
+			// 保护到期, 重新评估最近一次的结果
+			r.update(r.pendingDC, r.pending)
 		}
+	}
+}
 
-		index, ss, err := r.getService(lastIndex)
-		if err != nil {
-			select {
-			case <-r.ctx.Done():
-				{
-					//log.Infof("consulResolver.watcher ctx.Done. so exit")
-					return
-				}
-			default:
-			}
+// nodeIdentity 是节点的完整标识, 版本或元数据变化也要通知 grpc
+func nodeIdentity(svc *registry.Service, node *registry.Node) string {
+	// fmt 按 key 排序输出 map
+	return fmt.Sprintf("%s|%s|%v|%v", node.Id, svc.Version, node.Metadata, svc.Metadata)
+}
 
-			log.Errorf("err: %v", err)
-			errCnt += 1
+// update 比较新旧节点, 有变化时更新 grpc 的状态. dc 是 ss 所属机房的下标.
+func (r *consulResolver) update(dc int, ss []*registry.Service) {
+	r.pending, r.pendingDC = ss, dc
 
-			if errCnt >= 5 {
-				time.Sleep(time.Minute)
-			} else {
-				time.Sleep(time.Duration(3*errCnt) * time.Second)
-			}
+	// address -> identity
+	newAddrMap := map[string]string{}
+	var adds []resolver.Address
+
+	for _, svc := range ss {
+		if !r.filter.matchService(svc) {
 			continue
 		}
 
-		errCnt = 0
-		lastIndex = index
-		newAddrMap := map[string]*registry.Service{}
+		for _, node := range svc.Nodes {
+			if !r.filter.matchNode(svc, node) {
+				continue
+			}
+			if _, ok := newAddrMap[node.Address]; ok {
+				continue
+			}
 
-		for _, svc := range ss {
-			newAddrMap[svc.Nodes[0].Address] = svc
+			newAddrMap[node.Address] = nodeIdentity(svc, node)
+			adds = append(adds, resolver.Address{
+				Addr:       node.Address,
+				Attributes: addrattr.New(svc, node),
+			})
 		}
+	}
 
-		if len(newAddrMap) == 0 {
-			if len(r.addrMap) > 0 {
-				err := r.cc.UpdateState(resolver.State{Addresses: []resolver.Address{{}}})
-				if err != nil {
-					log.Errorf("resolver state empty addr. watcher:%s", r.svcString(), "err", err)
-					continue
-				}
-
-				r.addrMap = map[string]*registry.Service{}
-				log.Infof("resolver state empty addr. watcher:%s", r.svcString(), "err", err)
-			}
+	if r.protect(len(newAddrMap)) {
+		return
+	}
 
-			continue
-		} else {
-			if len(newAddrMap) == len(r.addrMap) {
-				isChange := false
-				for key, _ := range newAddrMap {
-					if _, ok := r.addrMap[key]; !ok {
-						isChange = true
-						break
-					}
-				}
-
-				if !isChange {
-					log.Info("no change")
-					continue
-				}
+	if len(newAddrMap) == 0 {
+		if len(r.addrMap) > 0 {
+			// 空地址会让 balancer 关闭之前的连接, 再报告原因, 调用直接失败而不是等待超时.
+			// balancer 对空地址返回 ErrBadResolverState, 不是错误.
+			err := r.cc.UpdateState(resolver.State{})
+			if err != nil && !errors.Is(err, balancer.ErrBadResolverState) {
+				log.Errorf("resolver state empty addr. watcher:%s err:%v", r.svcString(), err)
+				return
 			}
+			r.cc.ReportError(fmt.Errorf("consul resolver %s: no available nodes", r.svcString()))
 
-			adds := make([]resolver.Address, 0, len(newAddrMap))
-			for _, v := range newAddrMap {
-
-				attr := attributes.New("version", v.Version)
-				if len(v.Metadata) > 0 {
-					attr = attr.WithValue("metadata", v.Metadata)
-				}
+			r.addrMap = map[string]string{}
+			log.Infof("resolver state empty addr. watcher:%s", r.svcString())
+		}
 
-				//log.Infof("service:%s version:%s, addr:%s, servie metadata:%v, node metadata:%v",v.Name, v.Version, v.Nodes[0].Address, v.Metadata, v.Nodes[0].Metadata)
+		return
+	}
 
-				adds = append(adds, resolver.Address{
-					Addr:       v.Nodes[0].Address,
-					Attributes: attr,
-				})
+	if len(newAddrMap) == len(r.addrMap) {
+		isChange := false
+		for key, id := range newAddrMap {
+			if old, ok := r.addrMap[key]; !ok || old != id {
+				isChange = true
+				break
 			}
-			state := resolver.State{Addresses: adds}
+		}
 
-			log.Infof("r.cc.UpdateState, count:%d , addrs:%v", len(state.Addresses), state.Addresses)
-			err := r.cc.UpdateState(state)
-			if err != nil {
-				log.Errorf("resolver state update err. watcher:%s err:%v", r.svcString(), err)
-				continue
-			}
-			r.addrMap = newAddrMap
+		if !isChange {
+			log.Info("no change")
+			return
 		}
 	}
-}
 
-func (r *consulResolver) getService(lastIndex uint64) (uint64, []*registry.Service, error) {
-	ctx, cancel := context.WithTimeout(r.ctx, 60*time.Second)
-	defer cancel()
+	state := resolver.State{Addresses: adds}
 
-	queryOptions := &consul_api.QueryOptions{
-		WaitIndex:  lastIndex,
-		Near:       "_agent",
-		Datacenter: r.dc, // dc
-		WaitTime:   time.Minute,
+	log.Infof("r.cc.UpdateState, count:%d , addrs:%v", len(state.Addresses), state.Addresses)
+	err := r.cc.UpdateState(state)
+	if err != nil {
+		log.Errorf("resolver state update err. watcher:%s err:%v", r.svcString(), err)
+		return
 	}
-	queryOptions = queryOptions.WithContext(ctx)
+	r.addrMap = newAddrMap
 
-	var index uint64
-	resultFn := func(queryMeta *consul_api.QueryMeta) {
-		index = queryMeta.LastIndex
+	// 快照以主机房为 key, 只保存主机房的结果, 否则重启后会把备用机房的地址当作主机房的使用
+	if !r.seeding && dc == 0 {
+		r.snapshot.save(r.svcString(), ss)
 	}
-	ss, err := r.registry.GetService(r.svc,
-		consul_registry.PassingOnly(true),
-		consul_registry.QueryOptionsForGetService(queryOptions),
-		consul_registry.GetServiceResult(resultFn),
-	)
-
-	return index, ss, err
 }
 
-func (*consulResolver) ResolveNow(o resolver.ResolveNowOptions) {}
+// ResolveNow 让每个机房的查询立即刷新一次, 有频率限制
+func (r *consulResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	for _, w := range r.watches {
+		w.resolveNow()
+	}
+}
 
 func (r *consulResolver) Close() {
 	//log.Infof("consulResolver close enter, %s", r.svcString())
 
 	r.cancel()
 	r.wg.Wait()
+	r.stopProtect()
+
+	for i, w := range r.watches {
+		w.unsubscribe(r.updates[i])
+		releaseWatch(w)
+	}
 
 	//log.Infof("consulResolver close exit, %s", r.svcString())
 }
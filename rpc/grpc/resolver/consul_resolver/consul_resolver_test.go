@@ -0,0 +1,509 @@
+package consul_resolver
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/internal/testutil/resolvertest"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/addrattr"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	pollInterval = 50 * time.Millisecond
+	m.Run()
+}
+
+func TestResolverWithMemoryRegistry(t *testing.T) {
+	r := memory.NewRegistry()
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes: []*registry.Node{
+			{Id: "a", Address: "127.0.0.1:1001"},
+			{Id: "b", Address: "127.0.0.1:1002"},
+		},
+	})
+
+	b := &consulResolverBuilder{r: r}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "c", Address: "127.0.0.1:1003"}},
+	})
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 3 })
+}
+
+func TestResolversShareWatch(t *testing.T) {
+	r := memory.NewRegistry()
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "a", Address: "127.0.0.1:1001"}},
+	})
+
+	b := &consulResolverBuilder{r: r}
+	target := resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter"}}
+
+	cc1, cc2 := &resolvertest.ClientConn{}, &resolvertest.ClientConn{}
+	res1, err := b.Build(target, cc1, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	res2, err := b.Build(target, cc2, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+
+	key := watchKey{registry: r, svc: "Greeter"}
+	watches.Lock()
+	w := watches.m[key]
+	watches.Unlock()
+	if w == nil || w.refs != 2 {
+		t.Fatalf("expected one shared watch with 2 refs, got %+v", w)
+	}
+
+	resolvertest.WaitState(t, cc1, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+	resolvertest.WaitState(t, cc2, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+
+	res1.Close()
+	watches.Lock()
+	refs := w.refs
+	watches.Unlock()
+	if refs != 1 {
+		t.Fatalf("expected 1 ref after close, got %d", refs)
+	}
+
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v1",
+		Nodes:   []*registry.Node{{Id: "b", Address: "127.0.0.1:1002"}},
+	})
+	resolvertest.WaitState(t, cc2, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+
+	res2.Close()
+	watches.Lock()
+	_, ok := watches.m[key]
+	watches.Unlock()
+	if ok {
+		t.Fatal("watch should be removed after last resolver closed")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, q := range []string{"meta.=a", "color=red", "meta.zone=a&meta.zone=b"} {
+		query, _ := url.ParseQuery(q)
+		if _, err := parseFilter(query); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+
+	if f, err := parseFilter(nil); f != nil || err != nil {
+		t.Errorf("empty query: got %v %v", f, err)
+	}
+}
+
+func TestResolverFilter(t *testing.T) {
+	r := memory.NewRegistry()
+	r.Register(&registry.Service{
+		Name:     "Greeter",
+		Version:  "v1",
+		Metadata: map[string]string{"zone": "a"},
+		Nodes: []*registry.Node{
+			{Id: "a", Address: "127.0.0.1:1001", Metadata: map[string]string{"gray": "true"}},
+			{Id: "b", Address: "127.0.0.1:1002", Metadata: map[string]string{"gray": "true", "zone": "b"}},
+			{Id: "c", Address: "127.0.0.1:1003"},
+		},
+	})
+	r.Register(&registry.Service{
+		Name:    "Greeter",
+		Version: "v2",
+		Nodes: []*registry.Node{
+			{Id: "d", Address: "127.0.0.1:1004", Metadata: map[string]string{"gray": "true", "zone": "a"}},
+		},
+	})
+
+	b := &consulResolverBuilder{r: r}
+	for query, want := range map[string][]string{
+		"version=v1":                      {"127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1003"},
+		"version=v1&version=v2&tag=gray":  {"127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1004"},
+		"tag=gray&meta.zone=a":            {"127.0.0.1:1001", "127.0.0.1:1004"},
+		"version=v1&meta.zone=a":          {"127.0.0.1:1001", "127.0.0.1:1003"},
+		"version=v1&tag=gray&meta.zone=b": {"127.0.0.1:1002"},
+	} {
+		cc := &resolvertest.ClientConn{}
+		res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter", RawQuery: query}}, cc, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatalf("%s: build err: %v", query, err)
+		}
+
+		resolvertest.WaitState(t, cc, func(s resolver.State) bool {
+			var got []string
+			for _, a := range s.Addresses {
+				got = append(got, a.Addr)
+			}
+			sort.Strings(got)
+			return strings.Join(got, ",") == strings.Join(want, ",")
+		})
+		res.Close()
+	}
+}
+
+func TestResolverNodeMetadataChange(t *testing.T) {
+	r := memory.NewRegistry()
+	node := &registry.Node{Id: "a", Address: "127.0.0.1:1001"}
+	s := &registry.Service{Name: "Greeter", Version: "v1", Nodes: []*registry.Node{node}}
+	r.Register(s)
+
+	b := &consulResolverBuilder{r: r}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+
+	// 地址不变, 只有节点元数据变化
+	node.Metadata = map[string]string{"gray": "true"}
+	r.Register(s)
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool {
+		return len(s.Addresses) == 1 && addrattr.NodeMetadata(s.Addresses[0])["gray"] == "true"
+	})
+	if st, _ := cc.State(); addrattr.Version(st.Addresses[0]) != "v1" {
+		t.Errorf("version attribute lost: %v", st.Addresses[0].Attributes)
+	}
+}
+
+func TestResolveNow(t *testing.T) {
+	defer func(p, i time.Duration) { pollInterval, resolveNowInterval = p, i }(pollInterval, resolveNowInterval)
+	pollInterval, resolveNowInterval = time.Hour, 0
+
+	r := memory.NewRegistry()
+	r.Register(&registry.Service{Name: "Greeter", Version: "v1", Nodes: []*registry.Node{{Id: "a", Address: "127.0.0.1:1001"}}})
+
+	b := &consulResolverBuilder{r: r}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+
+	r.Register(&registry.Service{Name: "Greeter", Version: "v1", Nodes: []*registry.Node{{Id: "b", Address: "127.0.0.1:1002"}}})
+	res.ResolveNow(resolver.ResolveNowOptions{})
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+}
+
+func TestResolverProtection(t *testing.T) {
+	nodes := func(ids ...string) *registry.Service {
+		s := &registry.Service{Name: "Greeter", Version: "v1"}
+		for _, id := range ids {
+			s.Nodes = append(s.Nodes, &registry.Node{Id: id, Address: id + ":9000"})
+		}
+		return s
+	}
+
+	r := memory.NewRegistry()
+	r.Register(nodes("a", "b", "c", "d"))
+
+	var mu sync.Mutex
+	var events []bool
+	protecting := func() []bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]bool(nil), events...)
+	}
+
+	grace := 300 * time.Millisecond
+	b := &consulResolverBuilder{r: r, opts: newOptions(ProtectThreshold(50), ProtectGrace(grace), ProtectHandler(func(service string, p bool) {
+		if service != "Greeter" {
+			t.Errorf("unexpected service %s", service)
+		}
+		mu.Lock()
+		events = append(events, p)
+		mu.Unlock()
+	}))}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 4 })
+
+	// 4 -> 3 没有低于 50%, 直接接受
+	r.Deregister(nodes("d"))
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 3 })
+
+	// 3 -> 1 低于 50%, 保护期内保持 3 个地址
+	start := time.Now()
+	r.Deregister(nodes("b", "c"))
+	time.Sleep(grace / 2)
+	if s, _ := cc.State(); len(s.Addresses) != 3 {
+		t.Fatalf("expected previous addresses during grace, got %v", s.Addresses)
+	}
+	if e := protecting(); len(e) != 1 || !e[0] {
+		t.Errorf("expected protection started, got %v", e)
+	}
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+	if time.Since(start) < grace {
+		t.Errorf("accepted before grace period")
+	}
+	if e := protecting(); len(e) != 2 || e[1] {
+		t.Errorf("expected protection ended, got %v", e)
+	}
+
+	// 恢复后再变为空, 保护期内不推送空地址
+	r.Register(nodes("a", "b"))
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+	r.Deregister(nodes("a", "b"))
+	time.Sleep(grace / 2)
+	if s, _ := cc.State(); len(s.Addresses) != 2 {
+		t.Fatalf("expected previous addresses during grace, got %v", s.Addresses)
+	}
+
+	// 保护到期后推送空地址, 并报告原因
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 0 })
+	if errs := cc.Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "no available nodes") {
+		t.Errorf("expected an error for no nodes, got %v", errs)
+	}
+
+	if e := protecting(); len(e) != 4 {
+		t.Errorf("expected 2 protections, got %v", e)
+	}
+}
+
+// downRegistry 模拟不可用的注册中心
+type downRegistry struct {
+	registry.Registry
+}
+
+func (downRegistry) GetService(string, ...registry.GetOption) ([]*registry.Service, error) {
+	return nil, errors.New("registry is down")
+}
+
+func TestResolverSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	target := resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter"}}
+
+	r := memory.NewRegistry()
+	r.Register(&registry.Service{Name: "Greeter", Version: "v1", Nodes: []*registry.Node{
+		{Id: "a", Address: "127.0.0.1:1001"},
+		{Id: "b", Address: "127.0.0.1:1002"},
+	}})
+
+	b := &consulResolverBuilder{r: r, opts: newOptions(Snapshot(path))}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+	res.Close()
+
+	// 注册中心不可用时, 使用快照中的地址
+	b = &consulResolverBuilder{r: downRegistry{Registry: r}, opts: newOptions(Snapshot(path))}
+	cc = &resolvertest.ClientConn{}
+	res, err = b.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+	if s, _ := cc.State(); addrattr.Version(s.Addresses[0]) != "v1" {
+		t.Errorf("expected version from snapshot, got %v", s.Addresses[0])
+	}
+
+	// 其他服务没有快照
+	cc = &resolvertest.ClientConn{}
+	other, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Other"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer other.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := cc.State(); ok {
+		t.Errorf("expected no state without snapshot")
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		host  string
+		query string
+		svc   string
+		dcs   []string
+		err   bool
+	}{
+		{host: "Greeter", svc: "Greeter", dcs: []string{""}},
+		{host: "Greeter.dc1", svc: "Greeter", dcs: []string{"dc1"}},
+		{host: "Greeter", query: "dc=dc1&failover=dc2,dc3&version=v1", svc: "Greeter", dcs: []string{"dc1", "dc2", "dc3"}},
+		{host: "Greeter.dc1", query: "failover=dc2&failover=dc1,dc3", svc: "Greeter", dcs: []string{"dc1", "dc2", "dc3"}},
+		{host: "Greeter", query: "failover=dc2", svc: "Greeter", dcs: []string{"", "dc2"}},
+		{host: "Greeter.dc1", query: "dc=dc2", err: true},
+		{host: "Greeter", query: "dc=dc1&dc=dc2", err: true},
+		{host: "Greeter.dc1.x", err: true},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		svc, dcs, err := parseTarget(tt.host, query)
+		if (err != nil) != tt.err {
+			t.Errorf("%s?%s: unexpected err: %v", tt.host, tt.query, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if svc != tt.svc || strings.Join(dcs, "|") != strings.Join(tt.dcs, "|") {
+			t.Errorf("%s?%s: expected %s %q, got %s %q", tt.host, tt.query, tt.svc, tt.dcs, svc, dcs)
+		}
+		if _, ok := query["dc"]; ok {
+			t.Errorf("%s?%s: dc should be removed from query", tt.host, tt.query)
+		}
+		if _, ok := query["failover"]; ok {
+			t.Errorf("%s?%s: failover should be removed from query", tt.host, tt.query)
+		}
+	}
+}
+
+// nodes 返回一个机房的查询结果
+func nodes(addrs ...string) []*registry.Service {
+	s := &registry.Service{Name: "Greeter", Version: "v1"}
+	for _, addr := range addrs {
+		s.Nodes = append(s.Nodes, &registry.Node{Id: addr, Address: addr})
+	}
+	return []*registry.Service{s}
+}
+
+func hasAddr(addr string) func(resolver.State) bool {
+	return func(s resolver.State) bool { return len(s.Addresses) == 1 && s.Addresses[0].Addr == addr }
+}
+
+func TestResolverFailover(t *testing.T) {
+
+	// 注册中心不可用, 直接由各机房的查询投递结果
+	var mu sync.Mutex
+	var switches []string
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	b := &consulResolverBuilder{r: downRegistry{Registry: memory.NewRegistry()}, opts: newOptions(Snapshot(path), FailoverHandler(func(service, dc string) {
+		mu.Lock()
+		switches = append(switches, service+":"+dc)
+		mu.Unlock()
+	}))}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter", RawQuery: "dc=dc1&failover=dc2,dc3"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	r := res.(*consulResolver)
+	if len(r.updates) != 3 {
+		t.Fatalf("expected 3 dcs, got %d", len(r.updates))
+	}
+	// 主机房还没有结果时, 不能切换到备用机房
+	r.watches[2].publish(nodes("dc3:9000"))
+	time.Sleep(50 * time.Millisecond)
+	if s, ok := cc.State(); ok {
+		t.Fatalf("failed over before the primary dc answered: %v", s.Addresses)
+	}
+
+	r.watches[0].publish(nodes("dc1:9000"))
+	resolvertest.WaitState(t, cc, hasAddr("dc1:9000"))
+
+	// 主机房没有可用节点, 切换到下一个有节点的机房
+	r.watches[1].publish(nodes())
+	time.Sleep(50 * time.Millisecond)
+	r.watches[0].publish(nodes())
+	resolvertest.WaitState(t, cc, hasAddr("dc3:9000"))
+	mu.Lock()
+	if len(switches) != 1 || switches[0] != "Greeter.dc1:dc3" {
+		t.Errorf("expected a failover to dc3, got %v", switches)
+	}
+	mu.Unlock()
+
+	// 快照只保存主机房的结果
+	if ss := getSnapshotFile(path).load("Greeter.dc1"); len(ss) != 1 || len(ss[0].Nodes) != 1 || ss[0].Nodes[0].Address != "dc1:9000" {
+		t.Errorf("expected the primary dc in the snapshot, got %+v", ss)
+	}
+
+	r.watches[1].publish(nodes("dc2:9000"))
+	resolvertest.WaitState(t, cc, hasAddr("dc2:9000"))
+
+	// 主机房恢复后切回
+	r.watches[0].publish(nodes("dc1:9001"))
+	resolvertest.WaitState(t, cc, hasAddr("dc1:9001"))
+}
+
+func TestResolverFailoverErroringDC(t *testing.T) {
+	var mu sync.Mutex
+	var switches []string
+	b := &consulResolverBuilder{r: downRegistry{Registry: memory.NewRegistry()}, opts: newOptions(
+		FailoverWait(300*time.Millisecond),
+		FailoverHandler(func(service, dc string) {
+			mu.Lock()
+			switches = append(switches, service+":"+dc)
+			mu.Unlock()
+		}),
+	)}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "consul", Host: "Greeter", RawQuery: "dc=dc1&failover=dc2,dc3"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	// 注册中心不可用, dc2 的查询一直出错; dc1 没有节点, dc3 有节点
+	r := res.(*consulResolver)
+	r.watches[0].publish(nodes())
+	r.watches[2].publish(nodes("dc3:9000"))
+
+	// 等待期内不越过出错的机房
+	time.Sleep(100 * time.Millisecond)
+	if s, ok := cc.State(); ok {
+		t.Fatalf("failed over past the erroring dc before the wait: %v", s.Addresses)
+	}
+
+	resolvertest.WaitState(t, cc, hasAddr("dc3:9000"))
+	mu.Lock()
+	if len(switches) != 1 || switches[0] != "Greeter.dc1:dc3" {
+		t.Errorf("expected a failover to dc3, got %v", switches)
+	}
+	mu.Unlock()
+
+	// dc2 恢复后切换到它
+	r.watches[1].publish(nodes("dc2:9000"))
+	resolvertest.WaitState(t, cc, hasAddr("dc2:9000"))
+}
@@ -0,0 +1,150 @@
+package consul_resolver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// parseTarget 解析服务名和按优先级排列的机房, 例如
+//
+//	consul://Greeter.dc1
+//	consul://Greeter?dc=dc1&failover=dc2,dc3
+//
+// 第一个机房为主机房, "" 表示 agent 所在的机房.
+// dc 和 failover 会从 query 中删除, 剩下的是筛选条件.
+func parseTarget(host string, query url.Values) (string, []string, error) {
+	svc, dc := host, ""
+	split := strings.Split(host, ".")
+	if len(split) == 2 {
+		svc, dc = split[0], split[1]
+	} else if len(split) > 2 {
+		return "", nil, fmt.Errorf("host '%s' must be 'service{.dc}'", host)
+	}
+
+	if vs, ok := query["dc"]; ok {
+		if len(vs) != 1 || vs[0] == "" || dc != "" {
+			return "", nil, fmt.Errorf("dc must be given once, either in host or in query")
+		}
+		dc = vs[0]
+		delete(query, "dc")
+	}
+
+	dcs := []string{dc}
+	for _, v := range query["failover"] {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "" {
+				continue
+			}
+
+			dup := false
+			for _, d := range dcs {
+				dup = dup || d == f
+			}
+			if !dup {
+				dcs = append(dcs, f)
+			}
+		}
+	}
+	delete(query, "failover")
+
+	return svc, dcs, nil
+}
+
+// forward 把第 i 个机房的查询结果保存下来, 通知 watcher 重新选择机房
+func (r *consulResolver) forward(i int) {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case res := <-r.updates[i]:
+			r.mu.Lock()
+			if res.err != nil {
+				r.failed[i] = true
+			} else {
+				r.results[i] = res.services
+				r.known[i] = true
+				r.failed[i] = false
+			}
+			r.mu.Unlock()
+
+			select {
+			case r.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// active 返回第一个有可用节点的机房的下标和结果, 都没有时返回主机房的结果.
+// 还没有结果的机房状态未知, 不能越过它选择后面的机房, 此时返回 false, 保持当前的地址.
+// 查询一直出错的机房(如机房名写错或不可达)在 FailoverWait 之后按没有可用节点处理,
+// 但主机房没有结果时不会返回它的空结果.
+func (r *consulResolver) active() (int, []*registry.Service, bool) {
+	waited := time.Since(r.start) >= r.opts.FailoverWait
+
+	r.mu.Lock()
+	idx := -1
+	for i, ss := range r.results {
+		if !r.known[i] {
+			if r.failed[i] && waited {
+				continue
+			}
+			r.mu.Unlock()
+			return 0, nil, false
+		}
+		if r.countNodes(ss) > 0 {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		if !r.known[0] {
+			// 主机房没有结果, 保持当前的地址(如快照中的地址)
+			r.mu.Unlock()
+			return 0, nil, false
+		}
+		idx = 0
+	}
+	ss := r.results[idx]
+	r.mu.Unlock()
+
+	// activeIdx 只在 watcher 中使用
+	if len(r.dcs) > 1 && idx != r.activeIdx {
+		if idx == 0 {
+			log.Infof("consul resolver %s primary dc recovered, switch back from dc '%s'", r.svcString(), r.dcs[r.activeIdx])
+		} else {
+			log.Warnf("consul resolver %s no passing nodes before dc '%s', fail over to it", r.svcString(), r.dcs[idx])
+		}
+		r.activeIdx = idx
+
+		if r.opts.FailoverHandler != nil {
+			r.opts.FailoverHandler(r.svcString(), r.dcs[idx])
+		}
+	}
+
+	return idx, ss, true
+}
+
+// countNodes 返回满足筛选条件的节点数
+func (r *consulResolver) countNodes(ss []*registry.Service) int {
+	n := 0
+	for _, svc := range ss {
+		if !r.filter.matchService(svc) {
+			continue
+		}
+		for _, node := range svc.Nodes {
+			if r.filter.matchNode(svc, node) {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,87 @@
+package consul_resolver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// nodeFilter 根据 target 的查询参数(dc 和 failover 除外)筛选节点, 例如
+//
+//	consul://Greeter?version=v1.2.0&tag=gray&meta.zone=a
+//
+// version 可以出现多次, 匹配其中任意一个版本;
+// tag=gray 要求节点元数据 gray=true, 可以出现多次, 全部满足;
+// meta.k=v 要求节点元数据 k=v, 节点上没有 k 时使用服务元数据.
+type nodeFilter struct {
+	versions []string
+	tags     []string
+	meta     map[string]string
+}
+
+const metaPrefix = "meta."
+
+// parseFilter 解析查询参数, 没有筛选条件时返回 nil
+func parseFilter(query url.Values) (*nodeFilter, error) {
+	if len(query) == 0 {
+		return nil, nil
+	}
+
+	f := &nodeFilter{meta: make(map[string]string)}
+	for k, vs := range query {
+		switch {
+		case k == "version":
+			f.versions = append(f.versions, vs...)
+		case k == "tag":
+			f.tags = append(f.tags, vs...)
+		case strings.HasPrefix(k, metaPrefix) && len(k) > len(metaPrefix):
+			if len(vs) != 1 {
+				return nil, fmt.Errorf("query '%s' must be given once", k)
+			}
+			f.meta[strings.TrimPrefix(k, metaPrefix)] = vs[0]
+		default:
+			return nil, fmt.Errorf("unknown query '%s', supported: dc, failover, version, tag, meta.<key>", k)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *nodeFilter) matchService(s *registry.Service) bool {
+	if f == nil || len(f.versions) == 0 {
+		return true
+	}
+
+	for _, v := range f.versions {
+		if s.Version == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *nodeFilter) matchNode(s *registry.Service, n *registry.Node) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, tag := range f.tags {
+		if n.Metadata[tag] != "true" {
+			return false
+		}
+	}
+
+	for k, v := range f.meta {
+		got, ok := n.Metadata[k]
+		if !ok {
+			got, ok = s.Metadata[k]
+		}
+		if !ok || got != v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,89 @@
+package consul_resolver
+
+import (
+	"time"
+)
+
+type Options struct {
+	// ProtectThreshold 新的节点数低于之前的该百分比时, 保留之前的地址.
+	// 0 表示只在新的地址为空时保护.
+	ProtectThreshold int
+	// ProtectGrace 保护持续的时间, 超过后接受新的地址, 0 表示关闭保护
+	ProtectGrace time.Duration
+	// Snapshot 保存解析结果的文件, 为空表示不保存
+	Snapshot string
+	// ProtectHandler 在保护开始和结束时调用, 用于日志或监控
+	ProtectHandler func(service string, protecting bool)
+	// FailoverHandler 在切换机房时调用, 用于日志或监控
+	FailoverHandler func(service, dc string)
+	// FailoverWait 查询出错的机房在这段时间后按没有可用节点处理, 不再挡住后面的机房
+	FailoverWait time.Duration
+}
+
+type Option func(*Options)
+
+func newOptions(opts ...Option) Options {
+	options := Options{
+		ProtectGrace: 30 * time.Second,
+		FailoverWait: 10 * time.Second,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return options
+}
+
+// ProtectThreshold keeps the previous addresses when the number of nodes
+// drops below percent of the previous number, defaults to 0 which only
+// protects against an empty list.
+func ProtectThreshold(percent int) Option {
+	return func(o *Options) {
+		o.ProtectThreshold = percent
+	}
+}
+
+// ProtectGrace is how long the previous addresses are kept before an empty
+// or shrunken list is accepted, defaults to 30s. 0 disables the protection.
+func ProtectGrace(d time.Duration) Option {
+	return func(o *Options) {
+		o.ProtectGrace = d
+	}
+}
+
+// Snapshot saves the resolved addresses of every service to path, which
+// seeds the resolvers at startup until the registry answers.
+// A snapshot file should be used by one process only.
+func Snapshot(path string) Option {
+	return func(o *Options) {
+		o.Snapshot = path
+	}
+}
+
+// ProtectHandler is called with true when a service starts keeping its
+// previous addresses, and with false when the protection ends, for logs
+// or metrics. The service is given as service{.dc}.
+func ProtectHandler(fn func(service string, protecting bool)) Option {
+	return func(o *Options) {
+		o.ProtectHandler = fn
+	}
+}
+
+// FailoverHandler is called when a service with failover datacenters
+// switches to another datacenter, including back to the primary one.
+func FailoverHandler(fn func(service, dc string)) Option {
+	return func(o *Options) {
+		o.FailoverHandler = fn
+	}
+}
+
+// FailoverWait is how long a datacenter whose queries fail, for example a
+// misnamed or unreachable one, is waited for before it's treated as having
+// no nodes, so it doesn't block failing over to the next datacenters.
+// Defaults to 10s.
+func FailoverWait(d time.Duration) Option {
+	return func(o *Options) {
+		o.FailoverWait = d
+	}
+}
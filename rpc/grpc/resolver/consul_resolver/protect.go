@@ -0,0 +1,58 @@
+package consul_resolver
+
+import (
+	"time"
+
+	"github.com/robert-pkg/base4go/log"
+)
+
+// protect 判断是否保留之前的地址. 新的地址为空或低于阈值时开始保护,
+// 持续 ProtectGrace 后接受新的地址.
+func (r *consulResolver) protect(n int) bool {
+	old := len(r.addrMap)
+	shrink := n == 0 || n*100 < r.opts.ProtectThreshold*old
+	if r.opts.ProtectGrace <= 0 || old == 0 || !shrink {
+		r.stopProtect()
+		return false
+	}
+
+	if r.protectSince.IsZero() {
+		r.protectSince = time.Now()
+		r.graceTimer = time.NewTimer(r.opts.ProtectGrace)
+
+		if r.opts.ProtectHandler != nil {
+			r.opts.ProtectHandler(r.svcString(), true)
+		}
+		log.Warnf("consul resolver %s nodes %d -> %d, keep the previous addresses for %v", r.svcString(), old, n, r.opts.ProtectGrace)
+		return true
+	}
+
+	if time.Since(r.protectSince) < r.opts.ProtectGrace {
+		return true
+	}
+
+	log.Warnf("consul resolver %s nodes %d -> %d for %v, accept the new addresses", r.svcString(), old, n, r.opts.ProtectGrace)
+	r.stopProtect()
+	return false
+}
+
+func (r *consulResolver) stopProtect() {
+	if r.protectSince.IsZero() {
+		return
+	}
+
+	r.protectSince = time.Time{}
+	r.graceTimer.Stop()
+	r.graceTimer = nil
+	if r.opts.ProtectHandler != nil {
+		r.opts.ProtectHandler(r.svcString(), false)
+	}
+}
+
+// graceC 返回保护到期的 channel, 未在保护中时为 nil
+func (r *consulResolver) graceC() <-chan time.Time {
+	if r.graceTimer == nil {
+		return nil
+	}
+	return r.graceTimer.C
+}
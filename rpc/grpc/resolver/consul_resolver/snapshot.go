@@ -0,0 +1,135 @@
+package consul_resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// snapshotEntry 是一个服务最近一次解析到的结果
+type snapshotEntry struct {
+	Updated  time.Time           `json:"updated"`
+	Services []*registry.Service `json:"services"`
+}
+
+// snapshotFile 把每个 service{.dc} 最近一次解析到的结果保存到本地文件,
+// 启动时注册中心不可用, 也能先用文件中的地址.
+//
+//	{
+//	  "Greeter.dc1": {"updated": "...", "services": [...]}
+//	}
+type snapshotFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+// 同一个文件共用一个锁
+var snapshotFiles = struct {
+	sync.Mutex
+	m map[string]*snapshotFile
+}{
+	m: make(map[string]*snapshotFile),
+}
+
+func getSnapshotFile(path string) *snapshotFile {
+	if path == "" {
+		return nil
+	}
+
+	snapshotFiles.Lock()
+	defer snapshotFiles.Unlock()
+
+	f, ok := snapshotFiles.m[path]
+	if !ok {
+		f = &snapshotFile{path: path}
+		snapshotFiles.m[path] = f
+	}
+	return f
+}
+
+// read 读取整个文件, 文件不存在时返回空
+func (f *snapshotFile) read() (map[string]*snapshotEntry, error) {
+	entries := make(map[string]*snapshotEntry)
+
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// load 返回服务的快照, 没有时返回 nil
+func (f *snapshotFile) load(key string) []*registry.Service {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		log.Errorf("consul resolver read snapshot %s err: %v", f.path, err)
+		return nil
+	}
+
+	e, ok := entries[key]
+	if !ok {
+		return nil
+	}
+
+	log.Infof("consul resolver %s seeded from snapshot updated at %v", key, e.Updated)
+	return e.Services
+}
+
+// save 更新服务的快照, 先写临时文件再重命名
+func (f *snapshotFile) save(key string, ss []*registry.Service) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.read()
+	if err != nil {
+		// 文件损坏时重新生成
+		log.Errorf("consul resolver read snapshot %s err: %v", f.path, err)
+		entries = make(map[string]*snapshotEntry)
+	}
+	entries[key] = &snapshotEntry{Updated: time.Now(), Services: ss}
+
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		log.Errorf("consul resolver marshal snapshot err: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		log.Errorf("consul resolver write snapshot %s err: %v", f.path, err)
+		return
+	}
+
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		log.Errorf("consul resolver write snapshot %s err: %v", f.path, err)
+		return
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		log.Errorf("consul resolver write snapshot %s err: %v", f.path, err)
+	}
+}
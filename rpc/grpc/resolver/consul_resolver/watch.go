@@ -0,0 +1,330 @@
+package consul_resolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+	consul_registry "github.com/robert-pkg/base4go/registry/consul"
+)
+
+var (
+	// 注册中心不支持阻塞查询时的轮询间隔
+	pollInterval = 5 * time.Second
+	// ResolveNow 触发刷新的最小间隔
+	resolveNowInterval = 5 * time.Second
+)
+
+// 阻塞查询的等待时间, 以及比它略长的请求超时(consul 会在等待时间上加少量抖动)
+const (
+	queryWaitTime = time.Minute
+	queryTimeout  = queryWaitTime + 10*time.Second
+)
+
+type watchKey struct {
+	registry registry.Registry
+	svc, dc  string
+}
+
+// 同一个注册中心下, 相同服务/机房的 resolver 共享一个阻塞查询.
+// grpc_client 每次都会注册新的 builder, 所以放在包级别.
+var watches = struct {
+	sync.Mutex
+	m map[watchKey]*serviceWatch
+}{
+	m: make(map[watchKey]*serviceWatch),
+}
+
+// watchResult 是投递给订阅者的查询结果.
+// err 不为空表示还没有过成功的查询, 且最近一次查询出错.
+type watchResult struct {
+	services []*registry.Service
+	err      error
+}
+
+// serviceWatch 对一个服务做阻塞查询, 把结果分发给所有订阅的 resolver
+type serviceWatch struct {
+	key    watchKey
+	ctx    context.Context
+	cancel context.CancelFunc
+	refs   int // 受 watches 的锁保护
+
+	mu   sync.Mutex
+	subs map[chan watchResult]struct{}
+	last []*registry.Service
+	ok   bool  // 是否已经有过一次成功的查询
+	err  error // 没有成功的查询时, 最近一次查询的错误
+
+	// ResolveNow 取消进行中的阻塞查询, 或唤醒等待, 立即重新查询
+	refreshMu   sync.Mutex
+	queryCancel context.CancelFunc
+	refresh     bool
+	lastRefresh time.Time
+	wake        chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// acquireWatch 返回服务对应的共享查询, 不存在时启动一个
+func acquireWatch(r registry.Registry, svc, dc string) *serviceWatch {
+	key := watchKey{registry: r, svc: svc, dc: dc}
+
+	watches.Lock()
+	defer watches.Unlock()
+
+	w, ok := watches.m[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		w = &serviceWatch{
+			key:    key,
+			ctx:    ctx,
+			cancel: cancel,
+			subs:   make(map[chan watchResult]struct{}),
+			wake:   make(chan struct{}, 1),
+		}
+		watches.m[key] = w
+
+		w.wg.Add(1)
+		go w.run()
+	}
+
+	w.refs++
+	return w
+}
+
+// releaseWatch 减少引用计数, 最后一个 resolver 关闭时停止查询
+func releaseWatch(w *serviceWatch) {
+	watches.Lock()
+	w.refs--
+	stop := w.refs == 0
+	if stop {
+		delete(watches.m, w.key)
+	}
+	watches.Unlock()
+
+	if stop {
+		w.cancel()
+		w.wg.Wait()
+	}
+}
+
+// subscribe 订阅查询结果; 已有结果或错误时立即投递一份
+func (w *serviceWatch) subscribe() chan watchResult {
+	ch := make(chan watchResult, 1)
+
+	w.mu.Lock()
+	w.subs[ch] = struct{}{}
+	if w.ok {
+		ch <- watchResult{services: w.last}
+	} else if w.err != nil {
+		ch <- watchResult{err: w.err}
+	}
+	w.mu.Unlock()
+
+	return ch
+}
+
+// answered 返回是否已经有过一次成功的查询
+func (w *serviceWatch) answered() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ok
+}
+
+func (w *serviceWatch) unsubscribe(ch chan watchResult) {
+	w.mu.Lock()
+	delete(w.subs, ch)
+	w.mu.Unlock()
+}
+
+// publish 保存最新结果并投递给每个订阅者
+func (w *serviceWatch) publish(ss []*registry.Service) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.last = ss
+	w.ok = true
+	w.err = nil
+
+	w.send(watchResult{services: ss})
+}
+
+// publishErr 在还没有成功的查询时投递错误, 之后的错误不投递, 订阅者继续使用上一次的结果
+func (w *serviceWatch) publishErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ok {
+		return
+	}
+	w.err = err
+
+	w.send(watchResult{err: err})
+}
+
+// send 在持有锁时调用, 订阅者未及时处理时只保留最新的一份
+func (w *serviceWatch) send(res watchResult) {
+	for ch := range w.subs {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- res
+	}
+}
+
+func (w *serviceWatch) svcString() string {
+	svc := w.key.svc
+	if w.key.dc != "" {
+		svc += "." + w.key.dc
+	}
+
+	return svc
+}
+
+func (w *serviceWatch) run() {
+	defer w.wg.Done()
+
+	var lastIndex uint64
+	errCnt := 0
+	for {
+		select {
+		case <-w.ctx.Done():
+			log.Infof("consul resolver watch %s ctx.Done. so exit", w.svcString())
+			return
+		default:
+		}
+
+		index, ss, err := w.getService(lastIndex)
+		if w.takeRefresh() && err != nil && w.ctx.Err() == nil {
+			// 被 ResolveNow 取消, 不等待索引变化重新查询
+			lastIndex = 0
+			continue
+		}
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("consul resolver watch %s err: %v", w.svcString(), err)
+			w.publishErr(err)
+			errCnt += 1
+
+			d := time.Duration(3*errCnt) * time.Second
+			if errCnt >= 5 {
+				d = time.Minute
+			}
+			if !w.sleep(d) {
+				return
+			}
+			continue
+		}
+
+		errCnt = 0
+		lastIndex = index
+
+		w.publish(ss)
+
+		if index == 0 {
+			// 注册中心不支持阻塞查询(如 memory), 退化为定时轮询
+			if !w.sleep(pollInterval) {
+				return
+			}
+		}
+	}
+}
+
+// sleep 等待 d, 被 ResolveNow 唤醒时提前返回; 返回 false 表示已停止
+func (w *serviceWatch) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-w.ctx.Done():
+		return false
+	case <-w.wake:
+		w.takeRefresh()
+		return true
+	case <-t.C:
+		return true
+	}
+}
+
+// resolveNow 立即重新查询, 距离上次不足 resolveNowInterval 时忽略
+func (w *serviceWatch) resolveNow() {
+	w.refreshMu.Lock()
+	defer w.refreshMu.Unlock()
+
+	if time.Since(w.lastRefresh) < resolveNowInterval {
+		return
+	}
+	w.lastRefresh = time.Now()
+	w.refresh = true
+
+	if w.queryCancel != nil {
+		w.queryCancel()
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeRefresh 返回并清除 ResolveNow 的标记
+func (w *serviceWatch) takeRefresh() bool {
+	w.refreshMu.Lock()
+	defer w.refreshMu.Unlock()
+
+	refresh := w.refresh
+	w.refresh = false
+	if refresh {
+		select {
+		case <-w.wake:
+		default:
+		}
+	}
+	return refresh
+}
+
+func (w *serviceWatch) getService(lastIndex uint64) (uint64, []*registry.Service, error) {
+	ctx, cancel := context.WithTimeout(w.ctx, queryTimeout)
+	defer cancel()
+
+	w.refreshMu.Lock()
+	w.queryCancel = cancel
+	w.refreshMu.Unlock()
+	defer func() {
+		w.refreshMu.Lock()
+		w.queryCancel = nil
+		w.refreshMu.Unlock()
+	}()
+
+	queryOptions := &consul_api.QueryOptions{
+		WaitIndex:  lastIndex,
+		Near:       "_agent",
+		Datacenter: w.key.dc, // dc
+		WaitTime:   queryWaitTime,
+	}
+	queryOptions = queryOptions.WithContext(ctx)
+
+	var index uint64
+	resultFn := func(queryMeta *consul_api.QueryMeta) {
+		index = queryMeta.LastIndex
+	}
+	ss, err := w.key.registry.GetService(w.key.svc,
+		consul_registry.PassingOnly(true),
+		consul_registry.QueryOptionsForGetService(queryOptions),
+		consul_registry.GetServiceResult(resultFn),
+	)
+	if errors.Is(err, registry.ErrNotFound) {
+		return index, nil, nil
+	}
+
+	return index, ss, err
+}
@@ -0,0 +1,88 @@
+// Package direct_resolver provides a gRPC resolver for a fixed list of
+// addresses: direct://host1:port,host2:port (or direct:///host1:port,...).
+// It is useful for tests, scripts and services that are not registered.
+package direct_resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// Register registers a builder for the direct scheme globally, it must only
+// be called during initialization.
+func Register() {
+	resolver.Register(NewBuilder())
+}
+
+// NewBuilder returns a builder for the direct scheme, to be passed to grpc.WithResolvers.
+func NewBuilder() resolver.Builder {
+	return &directResolverBuilder{}
+}
+
+type directResolverBuilder struct{}
+
+func (*directResolverBuilder) Scheme() string {
+	return "direct"
+}
+
+func (b *directResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	endpoints := target.URL.Host
+	if endpoints == "" {
+		endpoints = strings.TrimPrefix(target.URL.Path, "/")
+	}
+
+	addrs, err := parseAddrs(endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("url '%s' err: %v. Must be in the next format: '%s://host1:port,host2:port'", target.URL.String(), err, b.Scheme())
+	}
+
+	if err := cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		return nil, err
+	}
+
+	return &directResolver{}, nil
+}
+
+// parseAddrs 解析逗号分隔的地址, 每个地址都要带端口, 重复的地址只保留一个
+func parseAddrs(endpoints string) ([]resolver.Address, error) {
+	var addrs []resolver.Address
+	seen := make(map[string]bool)
+
+	for _, ep := range strings.Split(endpoints, ",") {
+		ep = strings.TrimSpace(ep)
+		if ep == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(ep)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("address %q requires host and port", ep)
+		}
+
+		if seen[ep] {
+			continue
+		}
+		seen[ep] = true
+		addrs = append(addrs, resolver.Address{Addr: ep})
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+
+	return addrs, nil
+}
+
+// directResolver implements resolver.Resolver, the addresses never change
+type directResolver struct{}
+
+func (*directResolver) ResolveNow(o resolver.ResolveNowOptions) {}
+
+func (*directResolver) Close() {}
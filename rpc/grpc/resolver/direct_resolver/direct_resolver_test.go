@@ -0,0 +1,47 @@
+package direct_resolver
+
+import (
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/internal/testutil/resolvertest"
+)
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		url   url.URL
+		addrs []string
+		err   bool
+	}{
+		{url: url.URL{Scheme: "direct", Host: "127.0.0.1:9000,127.0.0.1:9001"}, addrs: []string{"127.0.0.1:9000", "127.0.0.1:9001"}},
+		{url: url.URL{Scheme: "direct", Path: "/127.0.0.1:9000,[::1]:9001,127.0.0.1:9000"}, addrs: []string{"127.0.0.1:9000", "[::1]:9001"}},
+		{url: url.URL{Scheme: "direct", Host: "localhost:9000"}, addrs: []string{"localhost:9000"}},
+		{url: url.URL{Scheme: "direct", Host: "127.0.0.1"}, err: true},
+		{url: url.URL{Scheme: "direct", Host: ":9000"}, err: true},
+		{url: url.URL{Scheme: "direct"}, err: true},
+	}
+
+	b := &directResolverBuilder{}
+	for _, tt := range tests {
+		cc := &resolvertest.ClientConn{}
+		_, err := b.Build(resolver.Target{URL: tt.url}, cc, resolver.BuildOptions{})
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected err: %v", tt.url.String(), err)
+			continue
+		}
+
+		got := cc.Addrs()
+		if len(got) != len(tt.addrs) {
+			t.Errorf("%s: expected %v, got %v", tt.url.String(), tt.addrs, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.addrs[i] {
+				t.Errorf("%s: expected %v, got %v", tt.url.String(), tt.addrs, got)
+				break
+			}
+		}
+	}
+}
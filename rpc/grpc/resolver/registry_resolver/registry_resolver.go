@@ -0,0 +1,240 @@
+// Package registry_resolver provides a gRPC resolver for the registry://service
+// scheme that works with any registry.Registry. The service is read again on
+// every change received through registry Watch and on ResolveNow, and polled
+// when the registry can't watch.
+package registry_resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/log"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/rpc/grpc/resolver/addrattr"
+)
+
+var (
+	// Watch 不可用时轮询的间隔, 以及重新 Watch 的间隔
+	pollInterval = 5 * time.Second
+	// ResolveNow 触发查询的最小间隔
+	resolveNowInterval = 5 * time.Second
+)
+
+// Register registers a builder for the registry scheme globally, it must only
+// be called during initialization.
+func Register(r registry.Registry) {
+	resolver.Register(NewBuilder(r))
+}
+
+// NewBuilder returns a builder for the registry scheme, to be passed to grpc.WithResolvers.
+func NewBuilder(r registry.Registry) resolver.Builder {
+	return &registryResolverBuilder{
+		r: r,
+	}
+}
+
+type registryResolverBuilder struct {
+	r registry.Registry
+}
+
+func (*registryResolverBuilder) Scheme() string {
+	return "registry"
+}
+
+func (b *registryResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	svc := target.URL.Host
+	if svc == "" {
+		svc = strings.TrimPrefix(target.URL.Path, "/")
+	}
+	if svc == "" {
+		return nil, fmt.Errorf("url '%s' err. Must be in the next format: '%s://service'", target.URL.String(), b.Scheme())
+	}
+
+	if b.r == nil {
+		return nil, errors.New("registry_resolver: no registry")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &registryResolver{
+		registry: b.r,
+		svc:      svc,
+		ctx:      ctx,
+		cancel:   cancel,
+		cc:       cc,
+		wake:     make(chan struct{}, 1),
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// registryResolver implements resolver.Resolver
+type registryResolver struct {
+	registry registry.Registry
+	svc      string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cc       resolver.ClientConn
+
+	// ResolveNow 时写入, 让 run 立即查询
+	wake        chan struct{}
+	mu          sync.Mutex
+	lastRefresh time.Time
+
+	// 排序后的节点标识, 用于判断是否有变化
+	addrs []string
+
+	wg sync.WaitGroup
+}
+
+func (r *registryResolver) run() {
+	defer r.wg.Done()
+
+	for r.ctx.Err() == nil {
+		w, err := r.registry.Watch(registry.WatchService(r.svc), registry.WatchContext(r.ctx))
+		if err != nil {
+			// 不支持 Watch 或暂时不可用, 先轮询一次, 稍后再试
+			log.Warnf("registry resolver watch %s err: %v, polling", r.svc, err)
+			r.refresh()
+			r.sleep(pollInterval)
+			continue
+		}
+
+		r.watch(w)
+		r.sleep(pollInterval)
+	}
+}
+
+// watch 先取全量, 之后每次收到事件或 ResolveNow 时重新取全量, 直到 watcher 出错或 resolver 关闭.
+// 事件只用作通知: 在取全量之前排队的事件可能比全量旧, 不能直接应用.
+func (r *registryResolver) watch(w registry.Watcher) {
+	// 多个事件合并为一次查询
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			res, err := w.Next()
+			if err != nil {
+				if r.ctx.Err() == nil && !errors.Is(err, registry.ErrWatcherStopped) {
+					log.Errorf("registry resolver watch %s next err: %v", r.svc, err)
+				}
+				return
+			}
+
+			if res.Service == nil || res.Service.Name != r.svc {
+				continue
+			}
+
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	defer func() {
+		w.Stop()
+		<-done
+	}()
+
+	r.refresh()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-done:
+			return
+		case <-changed:
+		case <-r.wake:
+		}
+
+		r.refresh()
+	}
+}
+
+// refresh 从注册中心取全量
+func (r *registryResolver) refresh() {
+	ss, err := r.registry.GetService(r.svc, registry.GetContext(r.ctx))
+	if err != nil && !errors.Is(err, registry.ErrNotFound) {
+		log.Errorf("registry resolver get %s err: %v", r.svc, err)
+		return
+	}
+
+	r.update(ss)
+}
+
+// sleep 等待 d, ResolveNow 时提前返回
+func (r *registryResolver) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-r.ctx.Done():
+	case <-t.C:
+	case <-r.wake:
+	}
+}
+
+// update 地址有变化时更新 grpc 的状态
+func (r *registryResolver) update(services []*registry.Service) {
+	var adds []resolver.Address
+	var keys []string
+	for _, s := range services {
+		for _, node := range s.Nodes {
+			adds = append(adds, resolver.Address{
+				Addr:       node.Address,
+				Attributes: addrattr.New(s, node),
+			})
+			// 版本或元数据变化也要通知 grpc, fmt 按 key 排序输出 map
+			keys = append(keys, fmt.Sprintf("%s|%s|%s|%v|%v", node.Address, node.Id, s.Version, node.Metadata, s.Metadata))
+		}
+	}
+	sort.Strings(keys)
+
+	if slices.Equal(keys, r.addrs) {
+		return
+	}
+
+	state := resolver.State{Addresses: adds}
+	if len(adds) == 0 {
+		state.Addresses = []resolver.Address{{}}
+	}
+
+	log.Infof("registry resolver %s UpdateState, count:%d , addrs:%v", r.svc, len(adds), adds)
+	if err := r.cc.UpdateState(state); err != nil {
+		log.Errorf("registry resolver %s update state err: %v", r.svc, err)
+		return
+	}
+	r.addrs = keys
+}
+
+// ResolveNow 立即重新查询, 距离上次不足 resolveNowInterval 时忽略
+func (r *registryResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastRefresh) < resolveNowInterval {
+		return
+	}
+	r.lastRefresh = time.Now()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *registryResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,147 @@
+package registry_resolver
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/internal/testutil/resolvertest"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+)
+
+func waitAddrs(t *testing.T, cc *resolvertest.ClientConn, n int) {
+	t.Helper()
+	resolvertest.WaitState(t, cc, func(s resolver.State) bool {
+		return len(s.Addresses) == n && s.Addresses[0].Addr != ""
+	})
+}
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	pollInterval = 50 * time.Millisecond
+	resolveNowInterval = 0
+	m.Run()
+}
+
+func testService(ids ...string) *registry.Service {
+	s := &registry.Service{Name: "Greeter", Version: "v1"}
+	for _, id := range ids {
+		s.Nodes = append(s.Nodes, &registry.Node{Id: id, Address: id + ":9000"})
+	}
+	return s
+}
+
+func build(t *testing.T, r registry.Registry) (resolver.Resolver, *resolvertest.ClientConn) {
+	t.Helper()
+
+	b := &registryResolverBuilder{r: r}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "registry", Host: "Greeter"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	t.Cleanup(res.Close)
+	return res, cc
+}
+
+func TestResolverWatch(t *testing.T) {
+	r := memory.NewRegistry()
+	r.Register(testService("a"))
+
+	_, cc := build(t, r)
+	waitAddrs(t, cc, 1)
+
+	r.Register(testService("b"))
+	waitAddrs(t, cc, 2)
+
+	r.Deregister(testService("a"))
+	waitAddrs(t, cc, 1)
+	if s, _ := cc.State(); s.Addresses[0].Addr != "b:9000" {
+		t.Errorf("unexpected addresses: %v", s.Addresses)
+	}
+}
+
+// noWatchRegistry 不支持 Watch
+type noWatchRegistry struct {
+	registry.Registry
+}
+
+func (noWatchRegistry) Watch(...registry.WatchOption) (registry.Watcher, error) {
+	return nil, errors.New("watch not supported")
+}
+
+func TestResolverPolling(t *testing.T) {
+	m := memory.NewRegistry()
+	m.Register(testService("a"))
+
+	_, cc := build(t, noWatchRegistry{m})
+	waitAddrs(t, cc, 1)
+
+	m.Register(testService("b"))
+	waitAddrs(t, cc, 2)
+}
+
+// stubRegistry 的 watcher 先返回 results, 之后阻塞到停止
+type stubRegistry struct {
+	registry.Registry
+	results []*registry.Result
+}
+
+func (s stubRegistry) Watch(...registry.WatchOption) (registry.Watcher, error) {
+	return &stubWatcher{results: s.results, exit: make(chan struct{})}, nil
+}
+
+type stubWatcher struct {
+	results []*registry.Result
+	exit    chan struct{}
+	once    sync.Once
+}
+
+func (w *stubWatcher) Next() (*registry.Result, error) {
+	if len(w.results) > 0 {
+		r := w.results[0]
+		w.results = w.results[1:]
+		return r, nil
+	}
+	<-w.exit
+	return nil, registry.ErrWatcherStopped
+}
+
+func (w *stubWatcher) Stop() {
+	w.once.Do(func() { close(w.exit) })
+}
+
+func TestResolverStaleEvent(t *testing.T) {
+	m := memory.NewRegistry()
+	m.Register(testService("a"))
+
+	// Watch 之后, 取全量之前排队的旧事件, 不能覆盖全量
+	_, cc := build(t, stubRegistry{m, []*registry.Result{
+		{Action: registry.Delete.String(), Service: testService()},
+	}})
+	waitAddrs(t, cc, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	if s, _ := cc.State(); len(s.Addresses) != 1 || s.Addresses[0].Addr != "a:9000" {
+		t.Errorf("stale event applied: %v", s.Addresses)
+	}
+}
+
+func TestResolveNow(t *testing.T) {
+	m := memory.NewRegistry()
+	m.Register(testService("a"))
+
+	// watcher 没有通知变化, ResolveNow 仍然能取到
+	res, cc := build(t, stubRegistry{Registry: m})
+	waitAddrs(t, cc, 1)
+
+	m.Register(testService("b"))
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	waitAddrs(t, cc, 2)
+}
@@ -0,0 +1,200 @@
+// Package srv_resolver provides a gRPC resolver which looks up DNS SRV records:
+//
+//	srv://_grpc._tcp.greeter.example.com
+//	srv://greeter.example.com   (looks up _grpc._tcp.greeter.example.com)
+//
+// Only the records with the lowest priority are used. The records are looked
+// up again every refreshInterval, and on ResolveNow.
+package srv_resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/log"
+)
+
+var (
+	// 定时重新查询的间隔
+	refreshInterval = 30 * time.Second
+	// ResolveNow 触发查询的最小间隔
+	resolveNowInterval = 5 * time.Second
+	// 单次查询的超时
+	lookupTimeout = 10 * time.Second
+
+	lookupSRV = net.DefaultResolver.LookupSRV
+)
+
+// Register registers a builder for the srv scheme globally, it must only
+// be called during initialization.
+func Register() {
+	resolver.Register(NewBuilder())
+}
+
+// NewBuilder returns a builder for the srv scheme, to be passed to grpc.WithResolvers.
+func NewBuilder() resolver.Builder {
+	return &srvResolverBuilder{}
+}
+
+type srvResolverBuilder struct{}
+
+func (*srvResolverBuilder) Scheme() string {
+	return "srv"
+}
+
+func (b *srvResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	name := target.URL.Host
+	if name == "" {
+		name = strings.TrimPrefix(target.URL.Path, "/")
+	}
+	if name == "" || strings.Contains(name, ":") {
+		return nil, fmt.Errorf("url '%s' err. Must be in the next format: '%s://_service._proto.name' or '%s://name'", target.URL.String(), b.Scheme(), b.Scheme())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &srvResolver{
+		name:   name,
+		ctx:    ctx,
+		cancel: cancel,
+		cc:     cc,
+		wake:   make(chan struct{}, 1),
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// srvResolver implements resolver.Resolver
+type srvResolver struct {
+	name   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	cc     resolver.ClientConn
+
+	// 排序后的地址, 用于判断是否有变化
+	addrs []string
+
+	mu          sync.Mutex
+	lastRefresh time.Time
+	wake        chan struct{}
+
+	wg sync.WaitGroup
+}
+
+func (r *srvResolver) run() {
+	defer r.wg.Done()
+
+	for {
+		r.refresh()
+
+		t := time.NewTimer(refreshInterval)
+		select {
+		case <-r.ctx.Done():
+			t.Stop()
+			return
+		case <-r.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// lookup 查询 SRV 记录, 返回优先级最高(priority 最小)的地址
+func (r *srvResolver) lookup() ([]string, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, lookupTimeout)
+	defer cancel()
+
+	var srvs []*net.SRV
+	var err error
+	if strings.HasPrefix(r.name, "_") {
+		_, srvs, err = lookupSRV(ctx, "", "", r.name)
+	} else {
+		_, srvs, err = lookupSRV(ctx, "grpc", "tcp", r.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, srv := range srvs {
+		// 结果已按 priority 排序
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	sort.Strings(addrs)
+
+	return slices.Compact(addrs), nil
+}
+
+// refresh 查询 SRV 记录, 地址有变化时更新 grpc 的状态.
+// 查询失败时保留之前的地址.
+func (r *srvResolver) refresh() {
+	addrs, err := r.lookup()
+	if err != nil {
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		log.Errorf("srv resolver lookup %s err: %v", r.name, err)
+		if r.addrs == nil {
+			r.cc.ReportError(err)
+		}
+		return
+	}
+
+	if r.addrs != nil && slices.Equal(addrs, r.addrs) {
+		return
+	}
+
+	state := resolver.State{}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	if len(state.Addresses) == 0 {
+		state.Addresses = []resolver.Address{{}}
+	}
+
+	log.Infof("srv resolver %s UpdateState, count:%d , addrs:%v", r.name, len(addrs), addrs)
+	if err := r.cc.UpdateState(state); err != nil {
+		log.Errorf("srv resolver %s update state err: %v", r.name, err)
+		return
+	}
+	r.addrs = addrs
+	if r.addrs == nil {
+		r.addrs = []string{}
+	}
+}
+
+// ResolveNow 立即重新查询, 距离上次不足 resolveNowInterval 时忽略
+func (r *srvResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastRefresh) < resolveNowInterval {
+		return
+	}
+	r.lastRefresh = time.Now()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *srvResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,98 @@
+package srv_resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/internal/testutil/resolvertest"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	resolveNowInterval = 0
+	m.Run()
+}
+
+func TestResolver(t *testing.T) {
+	var mu sync.Mutex
+	var lookups []string
+	records := []*net.SRV{
+		{Target: "b.example.com.", Port: 9001, Priority: 10},
+		{Target: "a.example.com.", Port: 9000, Priority: 10},
+		{Target: "backup.example.com.", Port: 9000, Priority: 20},
+	}
+	var lookupErr error
+
+	defer func(f func(context.Context, string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups = append(lookups, service+"|"+proto+"|"+name)
+		return "", records, lookupErr
+	}
+
+	b := &srvResolverBuilder{}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "srv", Host: "greeter.example.com"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	// 只使用优先级最高的记录
+	resolvertest.WaitAddrs(t, cc, "a.example.com:9000", "b.example.com:9001")
+
+	mu.Lock()
+	if lookups[0] != "grpc|tcp|greeter.example.com" {
+		t.Errorf("unexpected lookup %s", lookups[0])
+	}
+	records = records[1:]
+	mu.Unlock()
+
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	resolvertest.WaitAddrs(t, cc, "a.example.com:9000")
+
+	// 查询失败时保留之前的地址
+	mu.Lock()
+	lookupErr = errors.New("dns down")
+	mu.Unlock()
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	time.Sleep(100 * time.Millisecond)
+	resolvertest.WaitAddrs(t, cc, "a.example.com:9000")
+}
+
+func TestBuildFullName(t *testing.T) {
+	names := make(chan string, 1)
+	defer func(f func(context.Context, string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		select {
+		case names <- service + "|" + proto + "|" + name:
+		default:
+		}
+		return "", nil, errors.New("no such host")
+	}
+
+	b := &srvResolverBuilder{}
+	cc := &resolvertest.ClientConn{}
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: "srv", Path: "/_grpc._tcp.greeter.example.com"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer res.Close()
+
+	if name := <-names; name != "||_grpc._tcp.greeter.example.com" {
+		t.Errorf("unexpected lookup %s", name)
+	}
+
+	if _, err := b.Build(resolver.Target{URL: url.URL{Scheme: "srv", Host: "greeter.example.com:9000"}}, cc, resolver.BuildOptions{}); err == nil {
+		t.Errorf("expected err for address with port")
+	}
+}
@@ -0,0 +1,144 @@
+package grpc_server
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/robert-pkg/base4go/registry"
+)
+
+// 消息嵌套的最大展开深度. 接口会随注册信息写入每个节点, 只展开请求/响应的字段
+// 和下一层, 更深的字段只记录类型名, 避免注册信息和阻塞查询的结果过大
+const maxValueDepth = 2
+
+// serviceDescriptor 找到 ServiceInfo 注册到 grpc server 上的 proto 服务.
+// 优先按 PackageName.ServiceName 匹配, 否则按服务名匹配 proto 的全名后缀.
+func (g *grpcServer) serviceDescriptor(si *ServiceInfo) protoreflect.ServiceDescriptor {
+	infos := g.srv.GetServiceInfo()
+
+	name := ""
+	if _, ok := infos[si.GetKey()]; ok {
+		name = si.GetKey()
+	} else {
+		names := make([]string, 0, len(infos))
+		for full := range infos {
+			if full == si.ServiceName || strings.HasSuffix(full, "."+si.ServiceName) {
+				names = append(names, full)
+			}
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			name = names[0]
+		}
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil
+	}
+
+	sd, _ := d.(protoreflect.ServiceDescriptor)
+	return sd
+}
+
+// buildEndpoints 把服务的每个 rpc 方法转换为 registry.Endpoint
+func buildEndpoints(sd protoreflect.ServiceDescriptor) []*registry.Endpoint {
+	endpoints := []*registry.Endpoint{}
+	if sd == nil {
+		return endpoints
+	}
+
+	methods := sd.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		m := methods.Get(i)
+
+		md := map[string]string{
+			"method": "/" + string(sd.FullName()) + "/" + string(m.Name()),
+		}
+		switch {
+		case m.IsStreamingClient() && m.IsStreamingServer():
+			md["stream"] = "bidirectional"
+		case m.IsStreamingClient():
+			md["stream"] = "client"
+		case m.IsStreamingServer():
+			md["stream"] = "server"
+		}
+
+		endpoints = append(endpoints, &registry.Endpoint{
+			Name:     string(sd.Name()) + "." + string(m.Name()),
+			Request:  messageValue(m.Input()),
+			Response: messageValue(m.Output()),
+			Metadata: md,
+		})
+	}
+
+	return endpoints
+}
+
+func messageValue(md protoreflect.MessageDescriptor) *registry.Value {
+	return &registry.Value{
+		Name:   string(md.Name()),
+		Type:   string(md.FullName()),
+		Values: fieldValues(md, map[protoreflect.FullName]bool{md.FullName(): true}, 1),
+	}
+}
+
+// fieldValues 展开消息的字段, visited 记录当前路径上的消息, 遇到递归时不再展开
+func fieldValues(md protoreflect.MessageDescriptor, visited map[protoreflect.FullName]bool, depth int) []*registry.Value {
+	fields := md.Fields()
+	values := make([]*registry.Value, 0, fields.Len())
+
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		v := &registry.Value{
+			Name: string(fd.Name()),
+			Type: fieldType(fd),
+		}
+
+		msg := fd.Message()
+		if fd.IsMap() {
+			msg = fd.MapValue().Message()
+		}
+
+		if msg != nil && !visited[msg.FullName()] && depth < maxValueDepth {
+			visited[msg.FullName()] = true
+			v.Values = fieldValues(msg, visited, depth+1)
+			delete(visited, msg.FullName())
+		}
+
+		values = append(values, v)
+	}
+
+	return values
+}
+
+func fieldType(fd protoreflect.FieldDescriptor) string {
+	if fd.IsMap() {
+		return "map[" + kindType(fd.MapKey()) + "]" + kindType(fd.MapValue())
+	}
+
+	if fd.IsList() {
+		return "[]" + kindType(fd)
+	}
+
+	return kindType(fd)
+}
+
+func kindType(fd protoreflect.FieldDescriptor) string {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return string(fd.Message().FullName())
+	case protoreflect.EnumKind:
+		return string(fd.Enum().FullName())
+	default:
+		return fd.Kind().String()
+	}
+}
@@ -0,0 +1,78 @@
+package grpc_server
+
+import (
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestBuildEndpoints(t *testing.T) {
+	g := &grpcServer{srv: grpc.NewServer()}
+	healthpb.RegisterHealthServer(g.srv, health.NewServer())
+
+	// PackageName 与 proto 的包名不同时, 按服务名匹配
+	sd := g.serviceDescriptor(NewServiceInfo("Health", "Health", "v1", nil))
+	if sd == nil {
+		t.Fatal("service descriptor not found")
+	}
+
+	endpoints := buildEndpoints(sd)
+	byName := map[string]int{}
+	for i, e := range endpoints {
+		byName[e.Name] = i
+	}
+
+	i, ok := byName["Health.Check"]
+	if !ok {
+		t.Fatalf("Health.Check not found in %v", byName)
+	}
+
+	check := endpoints[i]
+	if check.Request.Type != "grpc.health.v1.HealthCheckRequest" || check.Response.Name != "HealthCheckResponse" {
+		t.Errorf("unexpected request/response: %+v %+v", check.Request, check.Response)
+	}
+	if len(check.Request.Values) != 1 || check.Request.Values[0].Name != "service" || check.Request.Values[0].Type != "string" {
+		t.Errorf("unexpected request fields: %+v", check.Request.Values)
+	}
+	if check.Metadata["method"] != "/grpc.health.v1.Health/Check" {
+		t.Errorf("unexpected method: %v", check.Metadata)
+	}
+
+	if i, ok := byName["Health.Watch"]; !ok || endpoints[i].Metadata["stream"] != "server" {
+		t.Errorf("expected Health.Watch to be server streaming")
+	}
+}
+
+func TestMessageValueRecursive(t *testing.T) {
+	v := messageValue((&structpb.Struct{}).ProtoReflect().Descriptor())
+
+	fields := v.Values
+	if len(fields) != 1 || fields[0].Type != "map[string]google.protobuf.Value" {
+		t.Fatalf("unexpected fields: %+v", fields)
+	}
+
+	// Struct -> Value -> Struct 形成递归, 再次遇到 Struct 时不再展开
+	for _, f := range fields[0].Values {
+		if f.Name == "struct_value" && len(f.Values) != 0 {
+			t.Errorf("recursive message should not be expanded: %+v", f.Values)
+		}
+	}
+}
+
+func TestMessageValueDepth(t *testing.T) {
+	// FileDescriptorSet -> FileDescriptorProto -> DescriptorProto -> ...
+	v := messageValue((&descriptorpb.FileDescriptorSet{}).ProtoReflect().Descriptor())
+
+	if len(v.Values) != 1 || v.Values[0].Name != "file" || len(v.Values[0].Values) == 0 {
+		t.Fatalf("expected the first level expanded: %+v", v.Values)
+	}
+	for _, f := range v.Values[0].Values {
+		if len(f.Values) != 0 {
+			t.Errorf("field %s deeper than %d should not be expanded: %+v", f.Name, maxValueDepth, f.Values)
+		}
+	}
+}
@@ -46,6 +46,7 @@ type grpcServer struct {
 	// registry service instance
 	reg_svc_map   map[string]*registry.Service
 	registeredMap map[string]bool
+	regStatus     server.RegisterStatus
 }
 
 func (g *grpcServer) Init() error {
@@ -138,6 +139,16 @@ func (g *grpcServer) startHttpServer(port int) error {
 		c.String(http.StatusOK, "status ok!")
 	})
 
+	// 注册状态, 最近一次注册失败时返回 503
+	router.GET("/status/registry", func(c *gin.Context) {
+		st := g.RegisterStatus()
+		code := http.StatusOK
+		if !st.Registered {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, st)
+	})
+
 	g.metrics_srv = &http.Server{
 		Addr:           addr,
 		Handler:        router,
@@ -227,6 +238,11 @@ func (g *grpcServer) Start(options ...server.StartOption) (err error) {
 			g.deregister()
 		}
 	}()
+
+	if g.checkMode() == CheckTTL && g.opts.RegisterTTL <= g.opts.RegisterInterval {
+		log.Warnf("RegisterTTL(%v) <= RegisterInterval(%v), nodes may expire between heartbeats", g.opts.RegisterTTL, g.opts.RegisterInterval)
+	}
+
 	for key, v := range g.reg_svc_map {
 		if err := g.register(v); err != nil {
 			return err
@@ -235,12 +251,20 @@ func (g *grpcServer) Start(options ...server.StartOption) (err error) {
 		}
 	}
 
+	g.Lock()
+	g.regStatus.Registered = true
+	g.regStatus.LastSuccess = time.Now()
+	g.regStatus.NextAttempt = g.regStatus.LastSuccess.Add(registerDelay(g.opts.RegisterInterval, 0))
+	next := time.Until(g.regStatus.NextAttempt)
+	g.Unlock()
+
 	// 服务发现注册成功了。 则服务健康
 	g.healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 	log.Infof("grpc server设置为健康")
 
 	go func() {
-		t := time.NewTicker(time.Second * 10)
+		// 按 RegisterInterval 续约, 注册中心不可用时指数退避
+		t := time.NewTimer(next)
 		defer func() {
 			t.Stop()
 		}()
@@ -254,11 +278,7 @@ func (g *grpcServer) Start(options ...server.StartOption) (err error) {
 			select {
 			// register self on interval
 			case <-t.C:
-				for _, v := range g.reg_svc_map {
-					if err := g.register(v); err != nil {
-						log.Errorf("register fail. %v\r\n", err)
-					}
-				}
+				t.Reset(g.registerAll())
 				// wait for exit
 			case ch = <-g.exit:
 				isQuit = true
@@ -1,12 +1,24 @@
 package grpc_server
 
 import (
+	"errors"
+	"math/rand"
 	"strconv"
 	"time"
 
 	"github.com/robert-pkg/base4go/log"
 	"github.com/robert-pkg/base4go/registry"
 	consul_registry "github.com/robert-pkg/base4go/registry/consul"
+	"github.com/robert-pkg/base4go/rpc/server"
+)
+
+var (
+	// 注册失败后第一次重试的等待时间, 之后每次翻倍, 最长为 RegisterInterval
+	registerBackoff = time.Second
+	// 每次等待时间上下浮动的比例, 避免大量实例同时注册
+	registerJitter = 0.1
+
+	defaultRegisterInterval = time.Second * 30
 )
 
 func (g *grpcServer) buildRegService(serviceInfoList []*ServiceInfo) {
@@ -25,29 +37,50 @@ func (g *grpcServer) buildRegService(serviceInfoList []*ServiceInfo) {
 			Version:   servcieInfo.Version,
 			Metadata:  servcieInfo.serviceMetadata,
 			Nodes:     []*registry.Node{node},
-			Endpoints: []*registry.Endpoint{},
+			Endpoints: buildEndpoints(g.serviceDescriptor(servcieInfo)),
 		}
 
-		log.Infof("Register service. key:%s node.Id:%s addr:%s", servcieInfo.GetKey(), node.Id, addr)
+		log.Infof("Register service. key:%s node.Id:%s addr:%s endpoints:%d", servcieInfo.GetKey(), node.Id, addr, len(reg_svc.Endpoints))
 		g.reg_svc_map[servcieInfo.GetKey()] = reg_svc
 	}
 }
 
-func (g *grpcServer) register(service *registry.Service) error {
+func (g *grpcServer) checkMode() CheckMode {
+	if g.opts.Context == nil {
+		return CheckAgent
+	}
+
+	if m, ok := g.opts.Context.Value(checkModeKey{}).(CheckMode); ok {
+		return m
+	}
+	return CheckAgent
+}
+
+func (g *grpcServer) registerOptions(service *registry.Service) []registry.RegisterOption {
 	g.RLock()
 	config := g.opts
 	g.RUnlock()
 
-	var regErr error
-	for i := 0; i < 3; i++ {
-		rOpts := []registry.RegisterOption{
-			consul_registry.TCPCheck(service.Nodes[0].Address, time.Second*10, time.Second*5),
-			consul_registry.HTTPCheck("http://"+g.host+":"+strconv.Itoa(g.httpPort)+"/status", time.Second*10, time.Second*5),
+	if g.checkMode() == CheckTTL {
+		// 只依靠 TTL 心跳, 不添加会清空 TTL 的 agent 检查
+		return []registry.RegisterOption{
 			registry.RegisterTTL(config.RegisterTTL),
 		}
+	}
+
+	return []registry.RegisterOption{
+		consul_registry.TCPCheck(service.Nodes[0].Address, time.Second*10, time.Second*5),
+		consul_registry.HTTPCheck("http://"+g.host+":"+strconv.Itoa(g.httpPort)+"/status", time.Second*10, time.Second*5),
+		registry.RegisterTTL(config.RegisterTTL),
+	}
+}
 
+// register 启动时注册, 失败后重试几次
+func (g *grpcServer) register(service *registry.Service) error {
+	var regErr error
+	for i := 0; i < 3; i++ {
 		// attempt to register
-		if err := config.Registry.Register(service, rOpts...); err != nil {
+		if err := g.opts.Registry.Register(service, g.registerOptions(service)...); err != nil {
 			// set the error
 			regErr = err
 			// backoff then retry
@@ -64,6 +97,70 @@ func (g *grpcServer) register(service *registry.Service) error {
 
 }
 
+// registerAll 定时注册(续约)所有服务, 更新注册状态, 返回下次注册前的等待时间
+func (g *grpcServer) registerAll() time.Duration {
+	var errs []error
+	for key, v := range g.reg_svc_map {
+		if err := g.opts.Registry.Register(v, g.registerOptions(v)...); err != nil {
+			log.Errorf("register fail. key:%s err:%v", key, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		g.Lock()
+		g.registeredMap[key] = true
+		g.Unlock()
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	if err := errors.Join(errs...); err != nil {
+		g.regStatus.Registered = false
+		g.regStatus.LastError = err.Error()
+		g.regStatus.Failures++
+	} else {
+		g.regStatus.Registered = true
+		g.regStatus.LastSuccess = now
+		g.regStatus.LastError = ""
+		g.regStatus.Failures = 0
+	}
+
+	d := registerDelay(g.opts.RegisterInterval, g.regStatus.Failures)
+	g.regStatus.NextAttempt = now.Add(d)
+	return d
+}
+
+// registerDelay 返回下次注册前的等待时间: 成功时为 interval,
+// 连续失败时从 registerBackoff 开始指数增长, 最长为 interval. 均带有随机抖动.
+func registerDelay(interval time.Duration, failures int) time.Duration {
+	if interval <= 0 {
+		interval = defaultRegisterInterval
+	}
+
+	d := interval
+	if failures > 0 {
+		d = registerBackoff
+		for i := 1; i < failures && d < interval; i++ {
+			d *= 2
+		}
+		if d > interval {
+			d = interval
+		}
+	}
+
+	return d + time.Duration((rand.Float64()*2-1)*registerJitter*float64(d))
+}
+
+// RegisterStatus returns the current registration state, for health reporting.
+func (g *grpcServer) RegisterStatus() server.RegisterStatus {
+	g.RLock()
+	defer g.RUnlock()
+
+	return g.regStatus
+}
+
 func (g *grpcServer) deregister() error {
 
 	for key, isRegistered := range g.registeredMap {
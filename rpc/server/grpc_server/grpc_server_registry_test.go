@@ -0,0 +1,106 @@
+package grpc_server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/robert-pkg/base4go/internal/testutil"
+	"github.com/robert-pkg/base4go/registry"
+	"github.com/robert-pkg/base4go/registry/memory"
+	"github.com/robert-pkg/base4go/rpc/server"
+)
+
+func TestMain(m *testing.M) {
+	testutil.InitLogger()
+	m.Run()
+}
+
+// failRegistry 注册时返回 err, 并记录最后一次的注册参数
+type failRegistry struct {
+	registry.Registry
+	err  error
+	opts registry.RegisterOptions
+}
+
+func (f *failRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	f.opts = registry.RegisterOptions{}
+	for _, o := range opts {
+		o(&f.opts)
+	}
+	return f.err
+}
+
+func testRegServer(r registry.Registry, opts ...server.Option) *grpcServer {
+	g := newGRPCServer(append([]server.Option{server.Registry(r), server.RegisterInterval(time.Minute)}, opts...)...)
+	g.host = "127.0.0.1"
+	g.port = 9000
+	g.buildRegService([]*ServiceInfo{NewServiceInfo("Greeter", "Greeter", "v1", nil)})
+	return g
+}
+
+func TestRegisterDelay(t *testing.T) {
+	interval := 30 * time.Second
+	within := func(d, want time.Duration) bool {
+		return d >= want-time.Duration(registerJitter*float64(want)) && d <= want+time.Duration(registerJitter*float64(want))
+	}
+
+	for failures, want := range map[int]time.Duration{
+		0:   interval,
+		1:   registerBackoff,
+		2:   2 * registerBackoff,
+		4:   8 * registerBackoff,
+		6:   interval,
+		100: interval,
+	} {
+		if d := registerDelay(interval, failures); !within(d, want) {
+			t.Errorf("failures %d: got %v, want %v ±%v", failures, d, want, registerJitter)
+		}
+	}
+
+	if d := registerDelay(0, 0); !within(d, defaultRegisterInterval) {
+		t.Errorf("zero interval: got %v", d)
+	}
+}
+
+func TestRegisterCheckMode(t *testing.T) {
+	f := &failRegistry{}
+
+	g := testRegServer(f, server.RegisterTTL(time.Minute*3), RegisterCheck(CheckTTL))
+	g.registerAll()
+	if f.opts.TTL != time.Minute*3 || f.opts.Context != nil {
+		t.Errorf("ttl mode should register with only a ttl, got %+v", f.opts)
+	}
+
+	g = testRegServer(f)
+	g.registerAll()
+	if f.opts.Context == nil {
+		t.Error("agent mode should register with agent checks")
+	}
+}
+
+func TestRegisterStatus(t *testing.T) {
+	f := &failRegistry{err: errors.New("registry down")}
+	g := testRegServer(f)
+
+	for i := 1; i <= 3; i++ {
+		d := g.registerAll()
+		st := g.RegisterStatus()
+		if st.Registered || st.Failures != i || st.LastError == "" {
+			t.Fatalf("attempt %d: unexpected status %+v", i, st)
+		}
+		if d > time.Minute {
+			t.Fatalf("attempt %d: backoff %v exceeds interval", i, d)
+		}
+	}
+
+	g.opts.Registry = memory.NewRegistry()
+	g.registerAll()
+	st := g.RegisterStatus()
+	if !st.Registered || st.Failures != 0 || st.LastError != "" || st.LastSuccess.IsZero() {
+		t.Fatalf("unexpected status after recovery %+v", st)
+	}
+	if !g.registeredMap["Greeter.Greeter"] {
+		t.Errorf("registeredMap not updated: %v", g.registeredMap)
+	}
+}
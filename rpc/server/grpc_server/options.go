@@ -13,6 +13,23 @@ func Options(opts ...grpc.ServerOption) server.Option {
 	return setServerOption(grpcOptions{}, opts)
 }
 
+// CheckMode selects how the registry decides that a node is alive.
+type CheckMode int
+
+const (
+	// CheckAgent 由 consul agent 对节点做 tcp 和 http 检查, 定时注册只确认检查存在 (默认)
+	CheckAgent CheckMode = iota
+	// CheckTTL 不做 agent 侧检查, 按 RegisterInterval 续约, 超过 RegisterTTL 未续约则节点失效
+	CheckTTL
+)
+
+type checkModeKey struct{}
+
+// RegisterCheck sets the CheckMode used when registering, defaults to CheckAgent.
+func RegisterCheck(m CheckMode) server.Option {
+	return setServerOption(checkModeKey{}, m)
+}
+
 type serviceInfoListKey struct{}
 
 func ServiceInfoList(services []*ServiceInfo) server.StartOption {
@@ -80,6 +80,15 @@ func RegisterTTL(interval time.Duration) Option {
 	}
 }
 
+// RegisterStatus is the registration state of a server, for health reporting.
+type RegisterStatus struct {
+	Registered  bool      `json:"registered"`   // 最近一次注册是否成功
+	LastSuccess time.Time `json:"last_success"` // 最近一次注册成功的时间
+	LastError   string    `json:"last_error"`   // 最近一次注册失败的原因
+	Failures    int       `json:"failures"`     // 连续失败的次数
+	NextAttempt time.Time `json:"next_attempt"` // 下一次注册的时间
+}
+
 type StartOptions struct {
 	// Other options for implementations of the interface
 	// can be stored in a context